@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	_ "crypto/sha512"
 	"encoding/hex"
@@ -9,6 +10,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -16,7 +18,10 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"text/template"
+	"time"
 
 	"github.com/cheggaaa/pb"
 	"github.com/cj123/go-ipsw/api"
@@ -24,32 +29,186 @@ import (
 )
 
 var (
-	ipswClient = api.NewIPSWClient("https://api.ipsw.me/v4", nil)
+	ipswClient *api.IPSWClient
+	httpClient *http.Client
 
-	filter, filterValue string
+	httpClientOptions httpOptions
+
+	apiBase       string
+	apiHeaders    headerFlags
+	apiRetries    int
+	apiWorkers    int
+	apiRateLimit  uint64
+	strictDevices bool
+
+	urlRewriteRules, downloadMirrors stringFlags
+	urlRewrites                      []urlRewrite
+
+	filter, filterValue, maxDownloadSize string
+	limitRate, limitSchedule             string
 
 	// flags
-	verifyIntegrity, reDownloadOnVerificationFailed, downloadSigned, downloadLatest bool
-	downloadDirectoryTemplate, specifiedDevice                                      string
+	verifyIntegrity, deepVerify, reDownloadOnVerificationFailed, downloadSigned, downloadLatest bool
+	downloadDirectoryTemplate, downloadFilenameTemplate, specifiedDevice, stateDir, metricsAddr string
 
 	// counters
-	downloadedSize, totalFirmwareSize    uint64
-	totalFirmwareCount, totalDeviceCount int
+	downloadedSize uint64
 )
 
 func init() {
 	flag.BoolVar(&downloadLatest, "l", false, "only download the latest firmware for the specified devices")
 	flag.BoolVar(&verifyIntegrity, "c", false, "just check the integrity of the currently downloaded files (if any)")
-	flag.BoolVar(&reDownloadOnVerificationFailed, "r", false, "redownload the file if it fails verification (w/ -c)")
+	flag.BoolVar(&deepVerify, "deep", false, "also check the zip structure, CRCs and manifests of each file (w/ -c)")
+	flag.BoolVar(&reDownloadOnVerificationFailed, "r", false, "redownload the file if it fails verification, up to 3 attempts (w/ -c)")
 	flag.BoolVar(&downloadSigned, "s", false, "only download signed firmwares")
 	flag.StringVar(&downloadDirectoryTemplate, "d", "./", "the location to save/check IPSW files.\n\tCan include templates e.g. {{.Identifier}} or {{.Name}} or {{.BuildID}}\n\n\tFor example try -d \"{{.Name}}/{{.Version}}\"\n")
+	flag.StringVar(&downloadFilenameTemplate, "filename", "", "the name to save IPSW files as, with the same templates as -d (default the name in the firmware URL)")
+	flag.StringVar(&stateDir, "state", "", "where to store cached API data (default \"<download directory>/.allthefirmwares\")")
 	flag.StringVar(&specifiedDevice, "i", "", "only download for the specified device")
 	flag.StringVar(&filter, "filter", "", "filter by a specific struct field")
 	flag.StringVar(&filterValue, "filterValue", "", "the value to filter by (used with -filter)")
-	flag.Parse()
+	flag.StringVar(&limitRate, "limit-rate", "", "limit the total download rate (e.g. 20MB/s)")
+	flag.StringVar(&limitSchedule, "limit-schedule", "", "daily rate limit windows, overriding -limit-rate while active (the shortest wins where they overlap).\n\tFor example \"08:00-18:00=2MB/s,12:00-13:00=pause\"\n")
+	flag.StringVar(&maxDownloadSize, "max-size", "", "only download up to this much data, newest firmwares first (e.g. 200GB)")
+	flag.DurationVar(&httpClientOptions.connectTimeout, "connect-timeout", 30*time.Second, "timeout for establishing connections (including TLS handshakes)")
+	flag.DurationVar(&httpClientOptions.idleTimeout, "idle-timeout", 90*time.Second, "how long idle keep-alive connections are kept open")
+	flag.DurationVar(&httpClientOptions.stallTimeout, "stall-timeout", 2*time.Minute, "abort a request if no data is received for this long")
+	flag.StringVar(&httpClientOptions.proxy, "proxy", "", "proxy URL to use (defaults to the HTTP_PROXY/HTTPS_PROXY environment variables)")
+	flag.StringVar(&httpClientOptions.caFile, "ca-file", "", "PEM file of additional CA certificates to trust")
+	flag.BoolVar(&httpClientOptions.insecure, "insecure", false, "skip TLS certificate verification")
+	flag.StringVar(&httpClientOptions.userAgent, "user-agent", "allthefirmwares", "the User-Agent to send with requests")
+	flag.Var(&httpClientOptions.headers, "header", "extra header to send with requests, e.g. \"X-Token: abc\" (can be repeated)")
+	flag.StringVar(&apiBase, "api", defaultAPIBase, "base URL of the ipsw.me compatible API to use")
+	flag.Var(&apiHeaders, "api-header", "extra header to send only to the API, e.g. \"Authorization: Bearer abc\" (can be repeated)")
+	flag.Var(&urlRewriteRules, "rewrite", "rewrite firmware URLs starting with a prefix before downloading, e.g.\n\t\"http://appldnld.apple.com/=http://cache.local/apple/\" (can be repeated)\n")
+	flag.Var(&downloadMirrors, "mirror", "fallback mirror base URL, tried in order if a download fails (can be repeated)")
+	flag.Var(&hookFlags, "hook", "run a command or POST to a URL on an event, e.g. \"on_download_complete=https://ci.local/hook\".\n\tEvents: on_download_complete, on_verify_failed, on_new_firmware, on_signing_change (can be repeated)\n")
+	flag.DurationVar(&hookTimeout, "hook-timeout", 30*time.Second, "timeout for each hook attempt")
+	flag.IntVar(&hookRetries, "hook-retries", 3, "how many times to retry a failed hook")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9100")
+	flag.StringVar(&outputFormat, "output", outputText, "output format: text, or json for one JSON event per line on stdout")
+	flag.IntVar(&apiRetries, "api-retries", 3, "how many times to retry failed API requests for a device")
+	flag.BoolVar(&strictDevices, "strict-devices", false, "exit with an error if the firmwares for any device could not be retrieved")
+	flag.BoolVar(&writeSidecars, "sidecar", true, "write <file>.json with the firmware and device information after downloading a file")
+	flag.BoolVar(&writeSHA1Files, "sha1-files", false, "write <file>.sha1 after downloading a file, for sha1sum -c")
+	flag.BoolVar(&writeSHA1Sums, "sha1sums", false, "add each downloaded file to a SHA1SUMS file in its directory, for sha1sum -c")
+	flag.IntVar(&apiWorkers, "api-workers", 4, "how many devices to fetch firmware information for at once")
+	flag.Uint64Var(&apiRateLimit, "api-rate", 10, "maximum API requests per second (0 for unlimited)")
+	flag.Usage = usage
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command] [command flags]\n\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  (none)\tdownload (or with -c, verify) firmwares\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  signing\tshow the signing status and history of firmwares\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  serve\tserve the archive as an ipsw.me v4 compatible API\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  watch\tkeep running, downloading new firmwares as they are released\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  proxy\tserve firmwares by their original URL path, downloading them on first request\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  inspect\tshow the manifests and contents of IPSW files\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  extract\tdownload only the matching files from inside IPSWs\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  import\tadd existing IPSW files to the archive\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+	flag.PrintDefaults()
 }
 
 func main() {
+	flag.Parse()
+	setup()
+
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr, catalogLibraryIndex)
+	}
+
+	switch command := flag.Arg(0); command {
+	case "":
+		os.Exit(mirror())
+	case "serve":
+		serve(flag.Args()[1:])
+	case "proxy":
+		proxy(flag.Args()[1:])
+	case "watch":
+		watch(flag.Args()[1:])
+	case "signing":
+		signing(flag.Args()[1:])
+	case "inspect":
+		inspect(flag.Args()[1:])
+	case "extract":
+		extract(flag.Args()[1:])
+	case "import":
+		importFirmwares(flag.Args()[1:])
+	default:
+		log.Fatalf("Unknown command: %s", command)
+	}
+}
+
+// setup configures the HTTP and API clients shared by every command.
+func setup() {
+	var err error
+
+	httpClient, err = newHTTPClient(httpClientOptions)
+
+	if err != nil {
+		log.Fatalf("Unable to configure HTTP client, err: %s", err)
+	}
+
+	webhookOptions := httpClientOptions
+	webhookOptions.headers = nil
+
+	webhookClient, err = newHTTPClient(webhookOptions)
+
+	if err != nil {
+		log.Fatalf("Unable to configure HTTP client, err: %s", err)
+	}
+
+	urlRewrites, err = parseURLRewrites(urlRewriteRules)
+
+	if err != nil {
+		log.Fatalf("Invalid URL rewrite, err: %s", err)
+	}
+
+	if outputFormat != outputText && outputFormat != outputJSON {
+		log.Fatalf("Unknown output format: %s", outputFormat)
+	}
+
+	hooks, err = parseHooks(hookFlags)
+
+	if err != nil {
+		log.Fatalf("Invalid hook, err: %s", err)
+	}
+
+	ipswClient = newAPIClient(apiBase, apiHeaders.header(), httpClient)
+	apiLimiter.setRate(apiRateLimit, false)
+
+	defaultRate, paused, err := parseRate(limitRate)
+
+	if err != nil {
+		log.Fatalf("Invalid rate limit: %s, err: %s", limitRate, err)
+	}
+
+	if paused {
+		log.Fatalf("Invalid rate limit: %s, pausing is only supported in -limit-schedule", limitRate)
+	}
+
+	bandwidthWindows, err := parseBandwidthSchedule(limitSchedule)
+
+	if err != nil {
+		log.Fatalf("Invalid rate limit schedule: %s, err: %s", limitSchedule, err)
+	}
+
+	applyBandwidthSchedule(bandwidthWindows, defaultRate)
+
+	if defaultRate > 0 {
+		log.Printf("Limiting download rate to %s", describeRate(defaultRate))
+	}
+}
+
+// mirror downloads (or verifies) every firmware matching the selection flags, returning the exit code.
+func mirror() int {
+	defer waitForHooks()
+
+	start := time.Now()
+
 	// catch interrupt
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -57,171 +216,451 @@ func main() {
 	go func() {
 		for range c {
 			// sig is a ^C, handle it
-			fmt.Println()
-			log.Printf("Downloaded %v\n", humanize.Bytes(uint64(downloadedSize)))
+			if outputFormat == outputText {
+				fmt.Println()
+			}
+
+			summary := summarize(start)
+
+			summary.log()
+			emit(outputEvent{Event: eventSummary, Summary: summary})
 
-			os.Exit(0)
+			os.Exit(exitInterrupted)
 		}
 	}()
 
+	var maxSize uint64
+	var err error
+
+	if maxDownloadSize != "" {
+		maxSize, err = humanize.ParseBytes(maxDownloadSize)
+
+		if err != nil {
+			log.Fatalf("Invalid maximum download size: %s, err: %s", maxDownloadSize, err)
+		}
+	}
+
 	log.Printf("Gathering IPSW information...")
 
+	localCatalog, err := loadCatalog(catalogPath())
+
+	if err != nil {
+		log.Printf("Unable to load catalog, err: %s", err)
+		localCatalog = &catalog{}
+	}
+
 	devices, err := ipswClient.Devices(false)
 
 	if err != nil {
-		log.Fatalf("Unable to retrieve firmware information, err: %s", err)
+		log.Printf("Unable to retrieve firmware information, err: %s", err)
+		return exitAPIError
 	}
 
-	firmwaresToDownload := make(map[api.BaseDevice][]api.Firmware)
+	var selectedDevices []api.BaseDevice
 
 	for _, device := range devices {
-		if specifiedDevice != "" && device.Identifier != specifiedDevice {
-			continue
+		if specifiedDevice == "" || device.Identifier == specifiedDevice {
+			selectedDevices = append(selectedDevices, device)
 		}
+	}
 
-		deviceInformation, err := ipswClient.DeviceInformation(device.Identifier)
+	// a download size budget needs the whole plan to pick the newest firmwares, otherwise
+	// each device's firmwares are downloaded while the remaining devices are fetched.
+	streaming := verifyIntegrity || maxSize == 0
 
-		if err != nil {
-			log.Printf("Could not get firmwares for device: %s, err: %s", device.Identifier, err)
+	queue := make(chan devicePlan, len(selectedDevices))
+	downloadsFinished := make(chan struct{})
+
+	go func() {
+		for plan := range queue {
+			downloadDeviceFirmwares(plan.device, plan.firmwares)
 		}
 
-		totalDeviceCount++
+		close(downloadsFinished)
+	}()
 
-		sort.Slice(deviceInformation.Firmwares, func(i int, j int) bool {
-			return deviceInformation.Firmwares[i].UploadDate.Time.After(deviceInformation.Firmwares[j].UploadDate.Time)
-		})
+	firmwaresToDownload := make(map[api.BaseDevice][]api.Firmware)
 
-		for index, ipsw := range deviceInformation.Firmwares {
-			if (downloadSigned && !ipsw.Signed) || (index > 0 && downloadLatest) {
-				continue
-			}
+	// the free space on each filesystem, less the firmwares already planned for it
+	remainingSpace := make(map[string]uint64)
+	plannedCount, fittedCount := 0, 0
 
-			if filter != "" && filterValue != "" && !passesFilter(ipsw, filter, filterValue) {
-				continue
-			}
+	var fetchedDevices []*api.Device
+	var deviceFailures []deviceFailure
+
+	for result := range fetchDevices(selectedDevices) {
+		device := result.device
+
+		if result.err != nil {
+			log.Printf("Could not get firmwares for device: %s, err: %s", device.Identifier, result.err)
+			deviceFailures = append(deviceFailures, deviceFailure{Identifier: device.Identifier, Error: result.err.Error()})
+			continue
+		}
+
+		localCatalog.setDevice(result.information)
+		fetchedDevices = append(fetchedDevices, result.information)
+
+		firmwares := planDeviceFirmwares(device, result.information)
+
+		if len(firmwares) == 0 {
+			continue
+		}
 
-			directory, err := parseDownloadDirectory(&ipsw, &device)
+		if !streaming {
+			firmwaresToDownload[device] = firmwares
+			continue
+		}
+
+		if !verifyIntegrity {
+			plannedCount += len(firmwares)
+
+			fitted, err := fitPlan(map[api.BaseDevice][]api.Firmware{device: firmwares}, 0, remainingSpace)
 
 			if err != nil {
-				log.Printf("Unable to parse download directory, err: %s", err)
-				continue
+				log.Printf("Unable to check free space, err: %s", err)
+			} else {
+				firmwares = fitted[device]
 			}
 
-			downloadPath := filepath.Join(directory, filepath.Base(ipsw.URL))
+			fittedCount += len(firmwares)
+		}
+
+		queueDeviceFirmwares(queue, device, firmwares)
+	}
+
+	if streaming && plannedCount > 0 && fittedCount == 0 {
+		log.Fatalf("None of the planned firmwares fit in the available space")
+	}
+
+	markSynced()
+
+	if err := localCatalog.save(catalogPath()); err != nil {
+		log.Printf("Unable to save catalog, err: %s", err)
+	}
+
+	recordSigningStatus(fetchedDevices)
+
+	if !streaming && len(firmwaresToDownload) > 0 {
+		firmwaresToDownload, err = fitPlan(firmwaresToDownload, maxSize, remainingSpace)
 
-			if _, err := os.Stat(downloadPath); os.IsNotExist(err) {
-				totalFirmwareCount++
-				totalFirmwareSize += ipsw.Filesize
+		if err != nil {
+			log.Fatalf("Unable to check free space, err: %s", err)
+		}
 
-				if firmwaresToDownload[device] == nil {
-					firmwaresToDownload[device] = make([]api.Firmware, 0)
-				}
+		if len(firmwaresToDownload) == 0 {
+			log.Fatalf("None of the planned firmwares fit in the available space")
+		}
 
-				firmwaresToDownload[device] = append(firmwaresToDownload[device], ipsw)
+		var count int
+		var size uint64
+
+		for _, firmwares := range firmwaresToDownload {
+			for _, ipsw := range firmwares {
+				count++
+				size += ipsw.Filesize
 			}
 		}
+
+		// with streaming, downloads have already started and each device's are logged instead
+		log.Printf("Downloading: %v IPSW files for %v device(s) (%v)", count, len(firmwaresToDownload), humanize.Bytes(size))
+
+		for device, firmwares := range firmwaresToDownload {
+			queueDeviceFirmwares(queue, device, firmwares)
+		}
+	}
+
+	close(queue)
+	<-downloadsFinished
+
+	summary := summarize(start)
+	summary.FailedDevices = deviceFailures
+
+	summary.log()
+	emit(outputEvent{Event: eventSummary, Summary: summary})
+
+	return summary.exitCode()
+}
+
+// devicePlan is a set of firmwares to download (or verify) for a device.
+type devicePlan struct {
+	device    api.BaseDevice
+	firmwares []api.Firmware
+}
+
+// planDeviceFirmwares returns the selected firmwares for a device which have not been downloaded yet,
+// or all selected firmwares if verifying.
+func planDeviceFirmwares(device api.BaseDevice, information *api.Device) []api.Firmware {
+	var planned []api.Firmware
+
+	for _, ipsw := range selectFirmwares(information) {
+		downloadPath, err := parseDownloadPath(&ipsw, &device)
+
+		if err != nil {
+			log.Printf("Unable to parse download path, err: %s", err)
+			continue
+		}
+
+		if _, err := os.Stat(downloadPath); os.IsNotExist(err) || verifyIntegrity {
+			planned = append(planned, ipsw)
+		} else {
+			atomic.AddUint64(&filesSkipped, 1)
+		}
 	}
 
+	return planned
+}
+
+// queueDeviceFirmwares adds firmwares for a device to the download queue.
+func queueDeviceFirmwares(queue chan<- devicePlan, device api.BaseDevice, firmwares []api.Firmware) {
+	if len(firmwares) == 0 {
+		return
+	}
+
+	for _, ipsw := range firmwares {
+		ipsw := ipsw
+
+		emit(firmwareEvent(eventPlan, &device, &ipsw, ""))
+	}
+
+	atomic.AddInt64(&downloadQueueDepth, int64(len(firmwares)))
+
+	queue <- devicePlan{device: device, firmwares: firmwares}
+}
+
+// downloadDeviceFirmwares downloads, or with -c verifies, firmwares for a device.
+func downloadDeviceFirmwares(device api.BaseDevice, firmwares []api.Firmware) {
 	if !verifyIntegrity {
-		log.Printf("Downloading: %v IPSW files for %v device(s) (%v)", totalFirmwareCount, totalDeviceCount, humanize.Bytes(totalFirmwareSize))
+		log.Printf("Downloading %d firmwares for %s", len(firmwares), device.Name)
 	}
 
-	for device, firmwares := range firmwaresToDownload {
+	for _, ipsw := range firmwares {
+		atomic.AddInt64(&downloadQueueDepth, -1)
+
+		if downloadSigned && !ipsw.Signed {
+			continue
+		}
+
+		downloadPath, err := parseDownloadPath(&ipsw, &device)
+
+		if err != nil {
+			log.Printf("Unable to parse download path, err: %s", err)
+			continue
+		}
+
+		directory, filename := filepath.Split(downloadPath)
+
+		// ensure download directory exists
 		if !verifyIntegrity {
-			log.Printf("Downloading %d firmwares for %s", len(firmwares), device.Name)
+			err := os.MkdirAll(directory, 0700)
+
+			if err != nil {
+				log.Printf("Unable to create download directory: %s, err: %s", directory, err)
+				break
+			}
 		}
 
-		for _, ipsw := range firmwares {
-			if downloadSigned && !ipsw.Signed {
+		_, err = os.Stat(downloadPath)
+
+		if os.IsNotExist(err) && !verifyIntegrity {
+			if err := ensureFreeSpace(directory, ipsw.Filesize); err != nil {
+				log.Printf("Skipping %s, err: %s", filename, err)
+				atomic.AddUint64(&filesSkipped, 1)
 				continue
 			}
 
-			filename := filepath.Base(ipsw.URL)
+			downloadWithRetries(context.Background(), &device, &ipsw, downloadPath)
+		} else if err == nil && verifyIntegrity {
+			fileOK, err := verifyFirmware(&device, &ipsw, downloadPath)
 
-			directory, err := parseDownloadDirectory(&ipsw, &device)
+			verified := firmwareEvent(eventVerify, &device, &ipsw, downloadPath)
+			verified.OK = boolPtr(fileOK)
 
 			if err != nil {
-				log.Printf("Unable to parse download directory, err: %s", err)
+				log.Printf("Error verifying: %s, err: %s", filename, err)
+				verified.Error = err.Error()
+			}
+
+			emit(verified)
+
+			// downloading the file again would give the same result
+			if err == errIntactChecksumMismatch {
+				atomic.AddUint64(&filesMismatched, 1)
+				fireHook(hookEvent{Event: hookVerifyFailed, Device: &device, Firmware: &ipsw, Path: downloadPath, Error: err.Error()})
 				continue
 			}
 
-			// ensure download directory exists
-			if !verifyIntegrity {
-				err := os.MkdirAll(directory, 0700)
+			if fileOK {
+				atomic.AddUint64(&filesVerified, 1)
+				log.Printf("%s verified successfully", filename)
+				continue
+			}
+
+			log.Printf("%s did not verify successfully", filename)
 
-				if err != nil {
-					log.Printf("Unable to create download directory: %s, err: %s", directory, err)
-					break
-				}
+			fireHook(hookEvent{Event: hookVerifyFailed, Device: &device, Firmware: &ipsw, Path: downloadPath})
+
+			// with -r, the outcome of the download replaces that of the verification
+			if reDownloadOnVerificationFailed {
+				downloadWithRetries(context.Background(), &device, &ipsw, downloadPath)
+			} else {
+				atomic.AddUint64(&filesCorrupt, 1)
 			}
+		} else if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error reading download path: %s, err: %s", downloadPath, err)
+		}
+	}
+}
 
-			downloadPath := filepath.Join(directory, filename)
+// selectFirmwares returns the firmwares for a device which match the selection flags, newest first.
+func selectFirmwares(device *api.Device) []api.Firmware {
+	sort.Slice(device.Firmwares, func(i int, j int) bool {
+		return device.Firmwares[i].UploadDate.Time.After(device.Firmwares[j].UploadDate.Time)
+	})
 
-			_, err = os.Stat(downloadPath)
+	var selected []api.Firmware
 
-			if os.IsNotExist(err) && !verifyIntegrity {
-				for {
-					err := downloadWithProgressBar(&ipsw, downloadPath)
+	for index, ipsw := range device.Firmwares {
+		if (downloadSigned && !ipsw.Signed) || (index > 0 && downloadLatest) {
+			continue
+		}
+
+		if filter != "" && filterValue != "" && !passesFilter(ipsw, filter, filterValue) {
+			continue
+		}
 
-					if err == nil || !reDownloadOnVerificationFailed {
-						break
-					}
-				}
-			} else if err == nil && verifyIntegrity {
-				fileOK, err := verify(downloadPath, ipsw.SHA1Sum)
+		selected = append(selected, ipsw)
+	}
 
-				if err != nil {
-					log.Printf("Error verifying: %s, err: %s", filename, err)
-				}
+	return selected
+}
 
-				if fileOK {
-					log.Printf("%s verified successfully", filename)
-					continue
-				}
+// maxDownloadAttempts is how many times a firmware is downloaded with -r before giving up.
+const maxDownloadAttempts = 3
 
-				log.Printf("%s did not verify successfully", filename)
+// downloadWithRetries downloads a firmware, trying again with -r, and counts its outcome once every
+// attempt is done: downloaded, corrupt if the last attempt failed its checksum, otherwise failed.
+func downloadWithRetries(ctx context.Context, device *api.BaseDevice, ipsw *api.Firmware, downloadPath string) error {
+	attempts := 1
 
-				if reDownloadOnVerificationFailed {
-					for {
-						err := downloadWithProgressBar(&ipsw, downloadPath)
+	if reDownloadOnVerificationFailed {
+		attempts = maxDownloadAttempts
+	}
 
-						if err == nil {
-							break
-						}
-					}
-				}
-			} else if err != nil && !os.IsNotExist(err) {
-				log.Printf("Error reading download path: %s, err: %s", downloadPath, err)
-			}
+	var err error
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("Retrying %s (attempt %d of %d)", filepath.Base(downloadPath), attempt, attempts)
+		}
+
+		err = downloadWithProgressBar(ctx, device, ipsw, downloadPath)
+
+		if err == nil || ctx.Err() != nil {
+			break
 		}
 	}
+
+	switch {
+	case err == nil:
+		atomic.AddUint64(&filesDownloaded, 1)
+	case err == errChecksum:
+		atomic.AddUint64(&filesCorrupt, 1)
+	default:
+		atomic.AddUint64(&filesFailed, 1)
+	}
+
+	return err
 }
 
-func downloadWithProgressBar(ipsw *api.Firmware, downloadPath string) error {
-	filename := filepath.Base(ipsw.URL)
+// downloadWithProgressBar downloads a firmware from each of its sources in turn until one matches its
+// checksum, returning the error from the last source if none do.
+func downloadWithProgressBar(ctx context.Context, device *api.BaseDevice, ipsw *api.Firmware, downloadPath string) error {
+	filename := filepath.Base(downloadPath)
 
-	log.Printf("Downloading %s (%s)", filename, humanize.Bytes(ipsw.Filesize))
+	var err error
 
-	bar := pb.New(int(ipsw.Filesize)).SetUnits(pb.U_BYTES)
-	bar.Start()
+	for _, source := range downloadSources(ipsw.URL) {
+		if source != ipsw.URL {
+			log.Printf("Downloading %s from %s (%s)", filename, source, humanize.Bytes(ipsw.Filesize))
+		} else {
+			log.Printf("Downloading %s (%s)", filename, humanize.Bytes(ipsw.Filesize))
+		}
 
-	checksum, err := download(ipsw.URL, downloadPath, bar, func(n, downloaded int, total int64) {
-		downloadedSize += uint64(n)
-	})
+		started := firmwareEvent(eventDownloadStarted, device, ipsw, downloadPath)
+		started.Source = source
+		emit(started)
 
-	bar.Finish()
+		progress := &progressEmitter{event: started, interval: time.Second}
+		progress.event.Event = eventDownloadProgress
 
-	if err != nil {
-		log.Printf("Error while downloading %s, err: %s", filename, err)
-		return err
-	} else if checksum != ipsw.SHA1Sum {
-		log.Printf("File: %s failed checksum (wanted: %s, got: %s)", filename, ipsw.SHA1Sum, checksum)
-		return errors.New("checksum incorrect")
+		var writer io.Writer = ioutil.Discard
+		var bar *pb.ProgressBar
+
+		if showProgressBar() {
+			bar = pb.New(int(ipsw.Filesize)).SetUnits(pb.U_BYTES)
+			bar.Start()
+
+			writer = bar
+		}
+
+		var checksum string
+
+		checksum, err = download(ctx, source, downloadPath, writer, func(n, downloaded int, total int64) {
+			atomic.AddUint64(&downloadedSize, uint64(n))
+			progress.update(downloaded)
+		})
+
+		if bar != nil {
+			bar.Finish()
+		}
+
+		if err == nil && checksum != ipsw.SHA1Sum {
+			log.Printf("File: %s failed checksum (wanted: %s, got: %s)", filename, ipsw.SHA1Sum, checksum)
+			err = errChecksum
+
+			fireHook(hookEvent{Event: hookVerifyFailed, Device: device, Firmware: ipsw, Path: downloadPath, Checksum: checksum, Error: err.Error()})
+		} else if err != nil {
+			log.Printf("Error while downloading %s, err: %s", filename, err)
+		}
+
+		if err != nil {
+			failed := firmwareEvent(eventDownloadFailed, device, ipsw, downloadPath)
+			failed.Source = source
+			failed.Checksum = checksum
+			failed.Error = err.Error()
+			emit(failed)
+
+			if ctx.Err() != nil {
+				break
+			}
+
+			continue
+		}
+
+		writeDownloadMetadata(device, ipsw, downloadPath, source, checksum)
+
+		completed := firmwareEvent(eventDownloadCompleted, device, ipsw, downloadPath)
+		completed.Source = source
+		completed.Checksum = checksum
+		emit(completed)
+
+		fireHook(hookEvent{Event: hookDownloadComplete, Device: device, Firmware: ipsw, Path: downloadPath, Checksum: checksum})
+
+		return nil
 	}
 
-	return nil
+	// don't leave a partial or corrupt file behind to be mistaken for a complete one
+	os.Remove(downloadPath)
+
+	return err
 }
 
+var errChecksum = errors.New("checksum incorrect")
+
+// errIntactChecksumMismatch is returned by verifyFirmware (with -deep) for a file which does not match
+// the API's checksum but is otherwise intact, which usually means the API's checksum is wrong.
+var errIntactChecksumMismatch = errors.New("checksum does not match the API, but the zip structure and manifests are intact")
+
 type fwDeviceCombo struct {
 	Identifier string
 	*api.BaseDevice
@@ -231,7 +670,7 @@ type fwDeviceCombo struct {
 func parseDownloadDirectory(fw *api.Firmware, device *api.BaseDevice) (string, error) {
 	directoryBuffer := new(bytes.Buffer)
 
-	t, err := template.New("firmware").Parse(downloadDirectoryTemplate)
+	t, err := template.New("firmware").Funcs(templateFuncs).Parse(downloadDirectoryTemplate)
 
 	if err != nil {
 		return "", err
@@ -240,19 +679,77 @@ func parseDownloadDirectory(fw *api.Firmware, device *api.BaseDevice) (string, e
 	err = t.Execute(directoryBuffer, &fwDeviceCombo{device.Identifier, device, fw})
 
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	return directoryBuffer.String(), err
 }
 
+// parseDownloadFilename returns the name to save a firmware as, from the -filename template or
+// otherwise the name of the file in its URL.
+func parseDownloadFilename(fw *api.Firmware, device *api.BaseDevice) (string, error) {
+	if downloadFilenameTemplate == "" {
+		return filepath.Base(fw.URL), nil
+	}
+
+	filenameBuffer := new(bytes.Buffer)
+
+	t, err := template.New("filename").Funcs(templateFuncs).Parse(downloadFilenameTemplate)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = t.Execute(filenameBuffer, &fwDeviceCombo{device.Identifier, device, fw})
+
+	if err != nil {
+		return "", err
+	}
+
+	filename := filenameBuffer.String()
+
+	if filename == "" || filename == "." || filename == ".." || strings.ContainsAny(filename, `/\`) {
+		return "", fmt.Errorf("invalid file name: %q (use -d for directories)", filename)
+	}
+
+	return filename, nil
+}
+
+// parseDownloadPath returns where a firmware is saved.
+func parseDownloadPath(fw *api.Firmware, device *api.BaseDevice) (string, error) {
+	directory, err := parseDownloadDirectory(fw, device)
+
+	if err != nil {
+		return "", err
+	}
+
+	filename, err := parseDownloadFilename(fw, device)
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, filename), nil
+}
+
 func verify(location string, expectedSHA1sum string) (bool, error) {
-	file, err := os.Open(location)
+	checksum, err := fileSHA1(location)
 
 	if err != nil {
 		return false, err
 	}
 
+	return expectedSHA1sum == checksum, nil
+}
+
+// fileSHA1 returns the hex encoded SHA1 of the file at location.
+func fileSHA1(location string) (string, error) {
+	file, err := os.Open(location)
+
+	if err != nil {
+		return "", err
+	}
+
 	defer file.Close()
 
 	h := sha1.New()
@@ -260,15 +757,43 @@ func verify(location string, expectedSHA1sum string) (bool, error) {
 	_, err = io.Copy(h, file)
 
 	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyFirmware checks a downloaded firmware against its SHA1 and, with -deep, its zip structure
+// and manifests. Without a SHA1, only the deep check is done.
+func verifyFirmware(device *api.BaseDevice, ipsw *api.Firmware, location string) (bool, error) {
+	if !deepVerify {
+		return verify(location, ipsw.SHA1Sum)
+	}
+
+	checksumOK := true
+
+	if ipsw.SHA1Sum != "" {
+		var err error
+
+		checksumOK, err = verify(location, ipsw.SHA1Sum)
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if err := verifyIPSWStructure(location, device, ipsw); err != nil {
 		return false, err
 	}
 
-	bs := h.Sum(nil)
+	if !checksumOK {
+		return false, errIntactChecksumMismatch
+	}
 
-	return expectedSHA1sum == hex.EncodeToString(bs), nil
+	return true, nil
 }
 
-func download(url string, location string, writer io.Writer, callback func(n, downloaded int, total int64)) (string, error) {
+func download(ctx context.Context, url string, location string, writer io.Writer, callback func(n, downloaded int, total int64)) (string, error) {
 	out, err := os.Create(location)
 
 	if err != nil {
@@ -280,7 +805,13 @@ func download(url string, location string, writer io.Writer, callback func(n, do
 	h := sha1.New()
 	mw := io.MultiWriter(out, h, writer)
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
 
 	if err != nil {
 		return "", err
@@ -288,12 +819,20 @@ func download(url string, location string, writer io.Writer, callback func(n, do
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
 	buf := make([]byte, 128*1024)
 
 	downloaded := 0
 
 	for {
 		if n, err := resp.Body.Read(buf); (err == nil || err == io.EOF) && n > 0 {
+			if err := bandwidthLimiter.wait(ctx, n); err != nil {
+				return "", err
+			}
+
 			_, err = mw.Write(buf[:n])
 
 			if err != nil {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+func TestDownloadWithRetriesCountsOnce(t *testing.T) {
+	const content = "firmware"
+
+	sum := sha1.Sum([]byte(content))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch filepath.Dir(r.URL.Path) {
+		case "/good":
+			w.Write([]byte(content))
+		case "/bad":
+			w.Write([]byte("corrupt"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer server.Close()
+
+	defer func(client *http.Client, rewrites []urlRewrite, redownload bool) {
+		httpClient, urlRewrites, reDownloadOnVerificationFailed = client, rewrites, redownload
+	}(httpClient, urlRewrites, reDownloadOnVerificationFailed)
+
+	httpClient = server.Client()
+
+	tests := []struct {
+		name       string
+		rewrite    string
+		url        string
+		redownload bool
+		err        bool
+
+		downloaded, failed, corrupt uint64
+	}{
+		{"first source", "", "/good/a.ipsw", false, false, 1, 0, 0},
+		{"bad source, good fallback", "/good/=/bad/", "/good/a.ipsw", false, false, 1, 0, 0},
+		{"missing source, good fallback", "/good/=/missing/", "/good/a.ipsw", false, false, 1, 0, 0},
+		{"every source corrupt", "", "/bad/a.ipsw", false, true, 0, 0, 1},
+		{"every source corrupt, retried", "", "/bad/a.ipsw", true, true, 0, 0, 1},
+		{"every source missing, retried", "", "/missing/a.ipsw", true, true, 0, 1, 0},
+	}
+
+	for _, test := range tests {
+		urlRewrites = nil
+
+		if test.rewrite != "" {
+			var err error
+
+			rule := strings.SplitN(test.rewrite, "=", 2)
+
+			urlRewrites, err = parseURLRewrites([]string{server.URL + rule[0] + "=" + server.URL + rule[1]})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reDownloadOnVerificationFailed = test.redownload
+
+		atomic.StoreUint64(&filesDownloaded, 0)
+		atomic.StoreUint64(&filesFailed, 0)
+		atomic.StoreUint64(&filesCorrupt, 0)
+
+		ipsw := &api.Firmware{URL: server.URL + test.url, SHA1Sum: hex.EncodeToString(sum[:])}
+
+		err := downloadWithRetries(context.Background(), &api.BaseDevice{}, ipsw, filepath.Join(t.TempDir(), "a.ipsw"))
+
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+
+		downloaded, failed, corrupt := atomic.LoadUint64(&filesDownloaded), atomic.LoadUint64(&filesFailed), atomic.LoadUint64(&filesCorrupt)
+
+		if downloaded != test.downloaded || failed != test.failed || corrupt != test.corrupt {
+			t.Errorf("%s: got downloaded: %d, failed: %d, corrupt: %d, expected %d, %d, %d", test.name, downloaded, failed, corrupt, test.downloaded, test.failed, test.corrupt)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+const defaultAPIBase = "https://api.ipsw.me/v4"
+
+// apiLimiter limits the rate of requests to the API, counting one token per request.
+var apiLimiter = &rateLimiter{}
+
+// maxRateLimitedRetries is how many times a request is retried after the API responds with
+// 429 Too Many Requests.
+const maxRateLimitedRetries = 5
+
+// newAPIClient creates a client for the ipsw.me compatible API at apiBase. headers are only
+// sent to the API, never to firmware download hosts.
+func newAPIClient(apiBase string, headers http.Header, client *http.Client) *api.IPSWClient {
+	apiHTTPClient := &http.Client{
+		Transport: &apiTransport{
+			transport: client.Transport,
+			headers:   headers,
+			basePath:  apiBasePath(apiBase),
+		},
+		Timeout: client.Timeout,
+	}
+
+	return api.NewIPSWClient(strings.TrimSuffix(apiBase, "/"), apiHTTPClient)
+}
+
+// apiTransport adds API specific headers (e.g. authentication) to requests and turns error
+// responses into errors, rather than letting them fail to decode as JSON.
+type apiTransport struct {
+	transport http.RoundTripper
+	headers   http.Header
+	basePath  string
+}
+
+// retryAfter parses a Retry-After header, given either in seconds or as an HTTP date, returning
+// fallback if it is missing or invalid.
+func retryAfter(value string, fallback time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+
+		return 0
+	}
+
+	return fallback
+}
+
+func apiBasePath(apiBase string) string {
+	u, err := url.Parse(apiBase)
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// endpoint returns the name of the API endpoint requested, e.g. "device" for /v4/device/iPhone10,3.
+func (t *apiTransport) endpoint(req *http.Request) string {
+	return strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, t.basePath), "/"), "/", 2)[0]
+}
+
+func (t *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	for key, values := range t.headers {
+		req.Header[key] = values
+	}
+
+	transport := t.transport
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		if err := apiLimiter.wait(req.Context(), 1); err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+
+		resp, err = transport.RoundTrip(req)
+
+		observeAPIRequest(t.endpoint(req), time.Since(start), err != nil || resp.StatusCode >= 400)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= maxRateLimitedRetries {
+			break
+		}
+
+		resp.Body.Close()
+
+		// back off every request, not just this one
+		delay := retryAfter(resp.Header.Get("Retry-After"), time.Duration(attempt+1)*5*time.Second)
+
+		log.Printf("API rate limit reached, waiting %s", delay)
+
+		apiLimiter.hold(delay)
+	}
+
+	if resp.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+
+		if message := strings.TrimSpace(string(body)); message != "" {
+			return nil, fmt.Errorf("api returned %s: %s", resp.Status, message)
+		}
+
+		return nil, fmt.Errorf("api returned %s", resp.Status)
+	}
+
+	return resp, nil
+}
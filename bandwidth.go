@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// bandwidthLimiter is shared by every download, so the limit applies to the total transfer rate.
+var bandwidthLimiter = &rateLimiter{}
+
+// rateLimiter is a token bucket limiting the number of bytes per second. Its rate can be changed at
+// any time, which takes effect on in-progress transfers.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	rate      uint64 // bytes per second, 0 is unlimited
+	paused    bool
+	allowance float64
+	last      time.Time
+	holdUntil time.Time
+}
+
+// setRate changes the limit to rate bytes per second (0 for unlimited), or pauses all transfers.
+func (l *rateLimiter) setRate(rate uint64, paused bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == rate && l.paused == paused {
+		return
+	}
+
+	l.rate = rate
+	l.paused = paused
+	l.allowance = 0
+	l.last = time.Now()
+}
+
+// hold stops all transfers for d, e.g. when the server has asked clients to back off.
+func (l *rateLimiter) hold(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(l.holdUntil) {
+		l.holdUntil = until
+	}
+}
+
+// wait blocks until n bytes may be transferred, or returns ctx's error if it is cancelled first.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		l.mu.Lock()
+
+		if l.paused {
+			l.mu.Unlock()
+			sleepContext(ctx, time.Second)
+			continue
+		}
+
+		if held := time.Until(l.holdUntil); held > 0 {
+			l.mu.Unlock()
+			sleepContext(ctx, held)
+			continue
+		}
+
+		if l.rate == 0 {
+			l.mu.Unlock()
+			return nil
+		}
+
+		now := time.Now()
+
+		// allow bursts of up to one second's worth of data
+		l.allowance += now.Sub(l.last).Seconds() * float64(l.rate)
+		l.last = now
+
+		if l.allowance > float64(l.rate) {
+			l.allowance = float64(l.rate)
+		}
+
+		if l.allowance >= 0 {
+			l.allowance -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+
+		delay := time.Duration(-l.allowance / float64(l.rate) * float64(time.Second))
+
+		l.mu.Unlock()
+
+		// sleep in short steps so that rate changes are picked up promptly
+		if delay > time.Second {
+			delay = time.Second
+		}
+
+		sleepContext(ctx, delay)
+	}
+}
+
+// sleepContext sleeps for d, returning early if ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// parseRate parses a rate such as "20MB/s", "512KiB" or "unlimited". "pause" and "off" stop transfers.
+func parseRate(s string) (rate uint64, paused bool, err error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+
+	switch s {
+	case "", "0", "unlimited":
+		return 0, false, nil
+	case "pause", "off":
+		return 0, true, nil
+	}
+
+	rate, err = humanize.ParseBytes(strings.TrimSuffix(s, "/s"))
+
+	return rate, false, err
+}
+
+// bandwidthWindow is a daily period (in minutes since midnight, local time) with its own rate.
+type bandwidthWindow struct {
+	start, end int
+	rate       uint64
+	paused     bool
+}
+
+func (w bandwidthWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+
+	// window wraps around midnight
+	return minute >= w.start || minute < w.end
+}
+
+// length returns how many minutes of the day the window covers.
+func (w bandwidthWindow) length() int {
+	if w.start <= w.end {
+		return w.end - w.start
+	}
+
+	return 24*60 - w.start + w.end
+}
+
+// parseBandwidthSchedule parses a comma separated list of windows, e.g. "08:00-18:00=2MB/s,12:00-13:00=pause".
+// Where windows overlap, the shortest one wins, so that exceptions can be carved out of longer windows.
+func parseBandwidthSchedule(schedule string) ([]bandwidthWindow, error) {
+	var windows []bandwidthWindow
+
+	for _, entry := range strings.Split(schedule, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		times := strings.SplitN(parts[0], "-", 2)
+
+		if len(parts) != 2 || len(times) != 2 {
+			return nil, fmt.Errorf("invalid schedule entry: %s (expected HH:MM-HH:MM=rate)", entry)
+		}
+
+		start, err := time.Parse("15:04", strings.TrimSpace(times[0]))
+
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := time.Parse("15:04", strings.TrimSpace(times[1]))
+
+		if err != nil {
+			return nil, err
+		}
+
+		rate, paused, err := parseRate(parts[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		windows = append(windows, bandwidthWindow{
+			start:  start.Hour()*60 + start.Minute(),
+			end:    end.Hour()*60 + end.Minute(),
+			rate:   rate,
+			paused: paused,
+		})
+	}
+
+	return windows, nil
+}
+
+// applyBandwidthSchedule sets the limiter's rate from the schedule, falling back to the default
+// rate outside of any window, and keeps it updated for the lifetime of the process.
+func applyBandwidthSchedule(windows []bandwidthWindow, defaultRate uint64) {
+	update := func() {
+		bandwidthLimiter.setRate(scheduledRate(windows, time.Now(), defaultRate))
+	}
+
+	update()
+
+	if len(windows) == 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(30 * time.Second) {
+			update()
+		}
+	}()
+}
+
+// scheduledRate returns the rate of the shortest window containing t, or the default rate outside
+// of any window.
+func scheduledRate(windows []bandwidthWindow, t time.Time, defaultRate uint64) (rate uint64, paused bool) {
+	var active *bandwidthWindow
+
+	for i, window := range windows {
+		if window.contains(t) && (active == nil || window.length() < active.length()) {
+			active = &windows[i]
+		}
+	}
+
+	if active == nil {
+		return defaultRate, false
+	}
+
+	return active.rate, active.paused
+}
+
+// describeRate formats a limiter rate for logging.
+func describeRate(rate uint64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+
+	return humanize.Bytes(rate) + "/s"
+}
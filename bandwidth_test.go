@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s      string
+		rate   uint64
+		paused bool
+		err    bool
+	}{
+		{"", 0, false, false},
+		{"unlimited", 0, false, false},
+		{"pause", 0, true, false},
+		{"OFF", 0, true, false},
+		{"20MB/s", 20000000, false, false},
+		{"512KiB", 512 * 1024, false, false},
+		{"fast", 0, false, true},
+	}
+
+	for _, test := range tests {
+		rate, paused, err := parseRate(test.s)
+
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.s, err)
+			continue
+		}
+
+		if rate != test.rate || paused != test.paused {
+			t.Errorf("%q: got %d (paused: %t), expected %d (paused: %t)", test.s, rate, paused, test.rate, test.paused)
+		}
+	}
+}
+
+func TestParseBandwidthScheduleErrors(t *testing.T) {
+	tests := []string{
+		"08:00-18:00",
+		"08:00=2MB/s",
+		"8am-6pm=2MB/s",
+		"08:00-25:00=2MB/s",
+		"08:00-18:00=fast",
+	}
+
+	for _, schedule := range tests {
+		if _, err := parseBandwidthSchedule(schedule); err == nil {
+			t.Errorf("%q: expected an error", schedule)
+		}
+	}
+}
+
+func TestScheduledRate(t *testing.T) {
+	windows, err := parseBandwidthSchedule("08:00-18:00=2MB/s,12:00-13:00=pause,22:00-06:00=unlimited")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const defaultRate = 1000000
+
+	tests := []struct {
+		time   string
+		rate   uint64
+		paused bool
+	}{
+		{"07:59", defaultRate, false},
+		{"08:00", 2000000, false},
+		{"11:59", 2000000, false},
+		{"12:30", 0, true},
+		{"13:00", 2000000, false},
+		{"18:00", defaultRate, false},
+		{"23:00", 0, false},
+		{"05:59", 0, false},
+		{"06:00", defaultRate, false},
+	}
+
+	for _, test := range tests {
+		at, err := time.Parse("15:04", test.time)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rate, paused := scheduledRate(windows, at, defaultRate)
+
+		if rate != test.rate || paused != test.paused {
+			t.Errorf("%s: got %d (paused: %t), expected %d (paused: %t)", test.time, rate, paused, test.rate, test.paused)
+		}
+	}
+}
+
+func TestRateLimiterWaitCancelledWhilePaused(t *testing.T) {
+	l := &rateLimiter{}
+	l.setRate(0, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- l.wait(ctx, 1)
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("got %v, expected %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return after the context was cancelled")
+	}
+}
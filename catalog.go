@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// catalog is a local copy of the API's device and firmware information, so that the archive
+// can be served and inspected without access to the API.
+type catalog struct {
+	Updated time.Time     `json:"updated"`
+	Devices []*api.Device `json:"devices"`
+}
+
+// archiveRoot returns the directory containing every path the download directory template can produce.
+func archiveRoot() string {
+	root := downloadDirectoryTemplate
+
+	if i := strings.Index(root, "{{"); i >= 0 {
+		root = root[:i]
+
+		// drop any partial path element leading up to the template action
+		if !strings.HasSuffix(root, "/") && !strings.HasSuffix(root, string(filepath.Separator)) {
+			root = filepath.Dir(root)
+		}
+	}
+
+	if root == "" {
+		return "."
+	}
+
+	return filepath.Clean(root)
+}
+
+// stateDirectory is where the catalog and other data about the archive are stored.
+func stateDirectory() string {
+	if stateDir != "" {
+		return stateDir
+	}
+
+	return filepath.Join(archiveRoot(), ".allthefirmwares")
+}
+
+func catalogPath() string {
+	return filepath.Join(stateDirectory(), "catalog.json")
+}
+
+// loadCatalog reads the catalog at path. A missing catalog is not an error, an empty one is returned instead.
+func loadCatalog(path string) (*catalog, error) {
+	c := &catalog{}
+
+	b, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, c)
+
+	return c, err
+}
+
+// save atomically writes the catalog to path.
+func (c *catalog) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(c, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, b, 0600)
+}
+
+// device returns the catalog entry for identifier, or nil.
+func (c *catalog) device(identifier string) *api.Device {
+	for _, device := range c.Devices {
+		if device.Identifier == identifier {
+			return device
+		}
+	}
+
+	return nil
+}
+
+// setDevice adds or replaces the catalog entry for device.
+func (c *catalog) setDevice(device *api.Device) {
+	c.Updated = time.Now()
+
+	for i, existing := range c.Devices {
+		if existing.Identifier == device.Identifier {
+			c.Devices[i] = device
+			return
+		}
+	}
+
+	c.Devices = append(c.Devices, device)
+}
+
+// deviceFailure is a device whose information could not be retrieved from the API.
+type deviceFailure struct {
+	Identifier string `json:"identifier"`
+	Error      string `json:"error"`
+}
+
+// fetchDeviceInformation retrieves the information for a device, retrying failed requests.
+func fetchDeviceInformation(identifier string) (*api.Device, error) {
+	var err error
+
+	for attempt := 0; attempt <= apiRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying device: %s (attempt %d of %d), err: %s", identifier, attempt, apiRetries, err)
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+
+		var device *api.Device
+
+		device, err = ipswClient.DeviceInformation(identifier)
+
+		if err == nil && device == nil {
+			err = errors.New("empty response")
+		}
+
+		if err == nil {
+			return device, nil
+		}
+	}
+
+	return nil, err
+}
+
+// fetchCatalog retrieves the information for every device from the API, or only the device
+// with the given identifier if it is not empty. Devices whose information could not be
+// retrieved are left out of the catalog and returned as failures.
+func fetchCatalog(identifier string) (*catalog, []deviceFailure, error) {
+	devices, err := ipswClient.Devices(false)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var selected []api.BaseDevice
+
+	for _, device := range devices {
+		if identifier == "" || device.Identifier == identifier {
+			selected = append(selected, device)
+		}
+	}
+
+	fetched := make(map[string]deviceResult)
+
+	for result := range fetchDevices(selected) {
+		fetched[result.device.Identifier] = result
+	}
+
+	c := &catalog{}
+
+	var failures []deviceFailure
+
+	// keep the catalog in the order the API lists devices
+	for _, device := range selected {
+		result := fetched[device.Identifier]
+
+		if result.err != nil {
+			log.Printf("Could not get firmwares for device: %s, err: %s", device.Identifier, result.err)
+			failures = append(failures, deviceFailure{Identifier: device.Identifier, Error: result.err.Error()})
+			continue
+		}
+
+		c.setDevice(result.information)
+	}
+
+	markSynced()
+
+	return c, failures, nil
+}
+
+// newFirmwares returns the firmwares in current which do not appear in c.
+func (c *catalog) newFirmwares(current *catalog) map[*api.Device][]api.Firmware {
+	added := make(map[*api.Device][]api.Firmware)
+
+	for _, device := range current.Devices {
+		known := make(map[string]bool)
+
+		if previous := c.device(device.Identifier); previous != nil {
+			for _, fw := range previous.Firmwares {
+				known[fw.BuildID+" "+fw.URL] = true
+			}
+		}
+
+		for _, fw := range device.Firmwares {
+			if !known[fw.BuildID+" "+fw.URL] {
+				added[device] = append(added[device], fw)
+			}
+		}
+	}
+
+	return added
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// decryptedSuffix is appended to the name of an extracted image to give the name of its decrypted payload.
+const decryptedSuffix = ".dec"
+
+var errUnsupportedImage = errors.New("not an IMG3, IM4P or IMG4 image")
+
+// decryptComponent writes the decrypted (and, for LZSS or LZFSE, decompressed) payload of the image at location
+// next to it, unless that has already been done. name is the image's file name in the IPSW, which is used
+// to find its key. keys is only called if the image is encrypted.
+func decryptComponent(location, name string, keys func() []api.FirmwareKey) error {
+	output := location + decryptedSuffix
+
+	if _, err := os.Stat(output); err == nil {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(location)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := decodeImage(b, name, keys)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Writing the payload of %s", name)
+
+	return writeFileAtomic(output, data, 0600)
+}
+
+// decodeImage returns the payload of an IMG3, IM4P or IMG4 image, decrypted with its key if it is
+// encrypted and decompressed if it uses LZSS or LZFSE.
+func decodeImage(b []byte, name string, keys func() []api.FirmwareKey) ([]byte, error) {
+	var imageType string
+	var data []byte
+	var encrypted bool
+
+	if p, err := parseIM4P(b); err == nil {
+		imageType, data, encrypted = p.Type, p.Data, len(p.KBags) > 0
+	} else if err != errNotIM4P {
+		return nil, err
+	} else if img, err := parseIMG3(b); err == nil {
+		imageType, data, encrypted = img.Type, img.Data, len(img.KBags) > 0
+	} else if err != errNotIMG3 {
+		return nil, err
+	} else {
+		return nil, errUnsupportedImage
+	}
+
+	if encrypted {
+		key := findFirmwareKey(keys(), name, imageNames[imageType])
+
+		if key == nil {
+			return nil, fmt.Errorf("no key for %s (%s)", name, imageType)
+		}
+
+		var err error
+
+		data, err = decryptAESCBC(data, key.Key, key.IV)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if bytes.HasPrefix(data, []byte("complzss")) {
+		return decompressLZSS(data)
+	}
+
+	if isLZFSE(data) {
+		return decompressLZFSE(data)
+	}
+
+	return data, nil
+}
+
+// fetchFirmwareKeys retrieves the published keys for the images in a firmware.
+func fetchFirmwareKeys(device *api.BaseDevice, ipsw *api.Firmware) ([]api.FirmwareKey, error) {
+	info, err := ipswClient.KeysForIPSW(device.Identifier, ipsw.BuildID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info == nil {
+		return nil, nil
+	}
+
+	return info.Keys, nil
+}
+
+// findFirmwareKey returns the key for the image with the given file name or, failing that, the only key
+// for its type of image.
+func findFirmwareKey(keys []api.FirmwareKey, filename, image string) *api.FirmwareKey {
+	for i, key := range keys {
+		if strings.EqualFold(key.Filename, filename) {
+			return &keys[i]
+		}
+	}
+
+	if image == "" {
+		return nil
+	}
+
+	var match *api.FirmwareKey
+
+	for i, key := range keys {
+		if normaliseImageName(key.Image) != normaliseImageName(image) {
+			continue
+		}
+
+		if match != nil {
+			// ambiguous, e.g. images for more than one board
+			return nil
+		}
+
+		match = &keys[i]
+	}
+
+	return match
+}
+
+func normaliseImageName(image string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "", " ", "").Replace(image))
+}
+
+// decryptAESCBC decrypts data with a hex encoded AES key and IV. If iv is empty, the key is
+// assumed to be the IV followed by the key, as keys are sometimes published. A trailing partial
+// block is left as it is.
+func decryptAESCBC(data []byte, keyHex, ivHex string) ([]byte, error) {
+	if ivHex == "" && len(keyHex) > 2*aes.BlockSize {
+		ivHex, keyHex = keyHex[:2*aes.BlockSize], keyHex[2*aes.BlockSize:]
+	}
+
+	key, err := hex.DecodeString(keyHex)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %s", keyHex)
+	}
+
+	iv, err := hex.DecodeString(ivHex)
+
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV: %s", ivHex)
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	blocks := len(out) - len(out)%aes.BlockSize
+
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out[:blocks], out[:blocks])
+
+	return out, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/cj123/go-ipsw/api"
+	"github.com/dustin/go-humanize"
+)
+
+// errFreeSpaceUnknown is returned by freeSpace on platforms where it can not be determined, in which
+// case free space checks are skipped.
+var errFreeSpaceUnknown = errors.New("free space is unknown on this platform")
+
+// existingParent returns the closest ancestor of directory (or directory itself) that exists on disk,
+// so that free space can be checked before the download directory has been created.
+func existingParent(directory string) string {
+	directory = filepath.Clean(directory)
+
+	for {
+		if _, err := os.Stat(directory); err == nil {
+			return directory
+		}
+
+		parent := filepath.Dir(directory)
+
+		if parent == directory {
+			return directory
+		}
+
+		directory = parent
+	}
+}
+
+// ensureFreeSpace checks that there is room for a file of the given size in directory.
+func ensureFreeSpace(directory string, size uint64) error {
+	available, err := freeSpace(existingParent(directory))
+
+	if err == errFreeSpaceUnknown {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if available < size {
+		return fmt.Errorf("not enough free space in %s (need %s, have %s)", directory, humanize.Bytes(size), humanize.Bytes(available))
+	}
+
+	return nil
+}
+
+type plannedFirmware struct {
+	device   api.BaseDevice
+	firmware api.Firmware
+}
+
+// fitPlan trims firmwaresToDownload so that it fits within maxSize (if non-zero) and the free space
+// of each destination filesystem. Firmwares are selected newest first. remainingSpace holds the space
+// left on each filesystem by earlier plans, and is updated with the space this plan will use.
+func fitPlan(firmwaresToDownload map[api.BaseDevice][]api.Firmware, maxSize uint64, remainingSpace map[string]uint64) (map[api.BaseDevice][]api.Firmware, error) {
+	var planned []plannedFirmware
+
+	for device, firmwares := range firmwaresToDownload {
+		for _, ipsw := range firmwares {
+			planned = append(planned, plannedFirmware{device: device, firmware: ipsw})
+		}
+	}
+
+	sort.SliceStable(planned, func(i, j int) bool {
+		return planned[i].firmware.UploadDate.Time.After(planned[j].firmware.UploadDate.Time)
+	})
+
+	fitted := make(map[api.BaseDevice][]api.Firmware)
+	var totalSize uint64
+
+	for _, p := range planned {
+		downloadPath, err := parseDownloadPath(&p.firmware, &p.device)
+
+		if err != nil {
+			return nil, err
+		}
+
+		directory, filename := filepath.Split(downloadPath)
+
+		if maxSize > 0 && totalSize+p.firmware.Filesize > maxSize {
+			log.Printf("Skipping %s, it would exceed the maximum download size of %s", filename, humanize.Bytes(maxSize))
+			atomic.AddUint64(&filesSkipped, 1)
+			continue
+		}
+
+		parent := existingParent(directory)
+
+		fsID, err := filesystemID(parent)
+
+		if err != nil {
+			return nil, err
+		}
+
+		available, ok := remainingSpace[fsID]
+
+		if !ok {
+			available, err = freeSpace(parent)
+
+			if err == errFreeSpaceUnknown {
+				available = math.MaxUint64
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if p.firmware.Filesize > available {
+			log.Printf("Skipping %s, not enough free space in %s (need %s, have %s)", filename, directory, humanize.Bytes(p.firmware.Filesize), humanize.Bytes(available))
+			remainingSpace[fsID] = available
+			atomic.AddUint64(&filesSkipped, 1)
+			continue
+		}
+
+		remainingSpace[fsID] = available - p.firmware.Filesize
+		totalSize += p.firmware.Filesize
+
+		fitted[p.device] = append(fitted[p.device], p.firmware)
+	}
+
+	return fitted, nil
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !linux && !darwin && !freebsd && !dragonfly
+// +build !windows,!linux,!darwin,!freebsd,!dragonfly
+
+package main
+
+// freeSpace is not implemented on this platform, so free space checks are skipped.
+func freeSpace(path string) (uint64, error) {
+	return 0, errFreeSpaceUnknown
+}
+
+// filesystemID treats every path as being on the same filesystem, as free space is unknown anyway.
+func filesystemID(path string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the number of bytes available to the current user on the filesystem containing path.
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+
+	err := syscall.Statfs(path, &stat)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// filesystemID returns an identifier which is the same for every path on a given filesystem.
+func filesystemID(path string) (string, error) {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+
+	if !ok {
+		return path, nil
+	}
+
+	return fmt.Sprintf("%d", stat.Dev), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the number of bytes available to the current user on the volume containing path.
+func freeSpace(path string) (uint64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var available uint64
+
+	r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&available)), 0, 0)
+
+	if r == 0 {
+		return 0, err
+	}
+
+	return available, nil
+}
+
+// filesystemID returns an identifier which is the same for every path on a given volume.
+func filesystemID(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToUpper(filepath.VolumeName(abs)), nil
+}
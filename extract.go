@@ -0,0 +1,347 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/cj123/go-ipsw/api"
+	"github.com/dustin/go-humanize"
+)
+
+// extract writes the files matching the given patterns from the firmwares selected by the usual flags.
+// Downloaded IPSWs are read locally, otherwise HTTP range requests are used to read just the parts of
+// each IPSW that are needed.
+func extract(args []string) {
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+
+	destination := flags.String("o", "", "where to write each file, e.g. \"{{.Identifier}}/{{.BuildID}}/{{.Component}}\"\n(default a directory named after the IPSW, in its download directory)")
+	localOnly := flags.Bool("local", false, "only extract from IPSWs which have been downloaded")
+	decrypt := flags.Bool("decrypt", false, "also write the decrypted payload of each image, using keys from the API, to <file>"+decryptedSuffix+"\n(LZSS and LZFSE compressed payloads are decompressed)")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] extract [extract flags] pattern...\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Patterns match file names in the IPSW, with or without their directory, e.g. \"kernelcache.*\" or \"Firmware/dfu/*\".\n\n")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	options := extractOptions{
+		patterns:  flags.Args(),
+		localOnly: *localOnly,
+		decrypt:   *decrypt,
+	}
+
+	if len(options.patterns) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	for _, pattern := range options.patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid pattern: %s, err: %s", pattern, err)
+		}
+	}
+
+	if *destination != "" {
+		t, err := template.New("extract").Funcs(templateFuncs).Parse(*destination)
+
+		if err != nil {
+			log.Fatalf("Invalid destination template: %s, err: %s", *destination, err)
+		}
+
+		options.destination = t
+		options.destinationRoot = templateRoot(*destination)
+	}
+
+	devices, err := ipswClient.Devices(false)
+
+	if err != nil {
+		log.Fatalf("Unable to retrieve firmware information, err: %s", err)
+	}
+
+	var selectedDevices []api.BaseDevice
+
+	for _, device := range devices {
+		if specifiedDevice == "" || device.Identifier == specifiedDevice {
+			selectedDevices = append(selectedDevices, device)
+		}
+	}
+
+	failed := false
+
+	for result := range fetchDevices(selectedDevices) {
+		if result.err != nil {
+			log.Printf("Could not get firmwares for device: %s, err: %s", result.device.Identifier, result.err)
+			failed = true
+			continue
+		}
+
+		device := result.device
+
+		for _, ipsw := range selectFirmwares(result.information) {
+			ipsw := ipsw
+
+			if err := extractFirmware(&device, &ipsw, options); err != nil {
+				log.Printf("Unable to extract from %s, err: %s", filepath.Base(ipsw.URL), err)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// extractOptions are which files to extract, and where to.
+type extractOptions struct {
+	patterns []string
+
+	// destination is the path of each extracted file, or nil to extract into a directory named
+	// after the IPSW, inside its download directory.
+	destination *template.Template
+
+	// destinationRoot is the directory which every destination must be inside, the part of the
+	// destination template before its first action.
+	destinationRoot string
+
+	// localOnly skips firmwares which have not been downloaded.
+	localOnly bool
+
+	// decrypt writes the decrypted payload of each extracted image next to it.
+	decrypt bool
+}
+
+// extractedFile is the data available to the extract destination template.
+type extractedFile struct {
+	fwDeviceCombo
+
+	// Component is the name of the file, e.g. kernelcache.release.n71
+	Component string
+
+	// Path is the path of the file in the IPSW, e.g. Firmware/all_flash/iBoot.n71ap.RELEASE.im4p
+	Path string
+}
+
+// extractFirmware extracts the files matching options.patterns from a firmware, skipping those which
+// have already been extracted.
+func extractFirmware(device *api.BaseDevice, ipsw *api.Firmware, options extractOptions) error {
+	downloadPath, err := parseDownloadPath(ipsw, device)
+
+	if err != nil {
+		return err
+	}
+
+	directory, filename := filepath.Split(downloadPath)
+
+	var z *zip.Reader
+
+	if local, err := zip.OpenReader(downloadPath); err == nil {
+		defer local.Close()
+
+		z = &local.Reader
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if options.localOnly {
+		return nil
+	} else {
+		for _, source := range downloadSources(ipsw.URL) {
+			z, err = openRemoteZip(source)
+
+			if err == nil {
+				break
+			}
+
+			log.Printf("Unable to read %s from %s, err: %s", filename, source, err)
+		}
+
+		if z == nil {
+			return err
+		}
+	}
+
+	var keys []api.FirmwareKey
+	keysFetched := false
+
+	firmwareKeys := func() []api.FirmwareKey {
+		if !keysFetched {
+			keysFetched = true
+
+			if keys, err = fetchFirmwareKeys(device, ipsw); err != nil {
+				log.Printf("Unable to get keys for %s, err: %s", filename, err)
+			}
+		}
+
+		return keys
+	}
+
+	matched, decryptFailed := 0, 0
+
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() || !matchesAnyPattern(f.Name, options.patterns) {
+			continue
+		}
+
+		matched++
+
+		var location string
+
+		if options.destination != nil {
+			location, err = extractDestination(options.destination, options.destinationRoot, device, ipsw, f.Name)
+		} else {
+			location, err = zipMemberPath(filepath.Join(directory, strings.TrimSuffix(filename, filepath.Ext(filename))), f.Name)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(location); os.IsNotExist(err) {
+			log.Printf("Extracting %s from %s (%s)", f.Name, filename, humanize.Bytes(f.UncompressedSize64))
+
+			if err := extractZipFile(f, location); err != nil {
+				return fmt.Errorf("%s: %s", f.Name, err)
+			}
+		}
+
+		if !options.decrypt {
+			continue
+		}
+
+		if err := decryptComponent(location, path.Base(f.Name), firmwareKeys); err == errUnsupportedImage {
+			continue
+		} else if err != nil {
+			log.Printf("Unable to decrypt %s, err: %s", f.Name, err)
+			decryptFailed++
+		}
+	}
+
+	if matched == 0 {
+		log.Printf("No files in %s match %s", filename, strings.Join(options.patterns, ", "))
+	}
+
+	if decryptFailed > 0 {
+		return fmt.Errorf("%d file(s) could not be decrypted", decryptFailed)
+	}
+
+	return nil
+}
+
+// extractDestination executes the destination template for the zip member name, refusing
+// destinations outside root, e.g. when the template uses a Path containing "..".
+func extractDestination(t *template.Template, root string, device *api.BaseDevice, ipsw *api.Firmware, name string) (string, error) {
+	buf := new(bytes.Buffer)
+
+	err := t.Execute(buf, &extractedFile{
+		fwDeviceCombo: fwDeviceCombo{device.Identifier, device, ipsw},
+		Component:     path.Base(name),
+		Path:          name,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("empty destination for %s", name)
+	}
+
+	location := filepath.Clean(buf.String())
+
+	if !insideDirectory(root, location) {
+		return "", fmt.Errorf("destination for %s is outside %s: %s", name, root, location)
+	}
+
+	return location, nil
+}
+
+// templateRoot returns the directory which every path the template s produces is inside, e.g.
+// "/srv/components" for "/srv/components/{{.Identifier}}/{{.Component}}".
+func templateRoot(s string) string {
+	if i := strings.Index(s, "{{"); i >= 0 {
+		s = s[:i]
+	}
+
+	return filepath.Dir(s + "x")
+}
+
+// matchesAnyPattern reports whether the name of a file in a zip, or its base name, matches any of patterns.
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// zipMemberPath returns where to extract the zip member name inside directory, refusing names which
+// would end up outside it.
+func zipMemberPath(directory, name string) (string, error) {
+	location := filepath.Join(directory, filepath.FromSlash(name))
+
+	if !insideDirectory(directory, location) {
+		return "", fmt.Errorf("invalid file name in IPSW: %s", name)
+	}
+
+	return location, nil
+}
+
+// insideDirectory reports whether location is directory or inside it.
+func insideDirectory(directory, location string) bool {
+	rel, err := filepath.Rel(directory, location)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// extractZipFile decompresses f to location, checking its CRC32. The file is written under a temporary
+// name first so that an interrupted extraction is not mistaken for a complete one.
+func extractZipFile(f *zip.File, location string) error {
+	if err := os.MkdirAll(filepath.Dir(location), 0700); err != nil {
+		return err
+	}
+
+	r, err := f.Open()
+
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	tmp := location + ".part"
+
+	out, err := os.Create(tmp)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, r)
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, location)
+}
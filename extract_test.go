@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"text/template"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+func TestExtractDestination(t *testing.T) {
+	device := &api.BaseDevice{Identifier: "iPhone10,3"}
+	ipsw := &api.Firmware{Identifier: "iPhone10,3", BuildID: "15D60"}
+
+	tests := []struct {
+		template string
+		name     string
+		expected string
+		err      bool
+	}{
+		{"/srv/components/{{.Identifier}}/{{.Component}}", "Firmware/all_flash/iBoot.d22.RELEASE.im4p", "/srv/components/iPhone10,3/iBoot.d22.RELEASE.im4p", false},
+		{"out/{{.BuildID}}/{{.Path}}", "Firmware/dfu/iBSS.d22.RELEASE.im4p", "out/15D60/Firmware/dfu/iBSS.d22.RELEASE.im4p", false},
+		{"{{.Identifier}}/{{.Path}}", "kernelcache.release.iphone10", "iPhone10,3/kernelcache.release.iphone10", false},
+		{"/srv/components/{{.Path}}", "../../etc/passwd", "", true},
+		{"out/{{.Path}}", "../escaped", "", true},
+		{"{{.Path}}", "/etc/passwd", "", true},
+		{"{{.Path}}", "../escaped", "", true},
+		{"{{if false}}x{{end}}", "kernelcache", "", true},
+	}
+
+	for _, test := range tests {
+		tmpl, err := template.New("test").Funcs(templateFuncs).Parse(test.template)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		location, err := extractDestination(tmpl, templateRoot(test.template), device, ipsw, test.name)
+
+		if (err != nil) != test.err {
+			t.Errorf("%s, %s: unexpected error: %v", test.template, test.name, err)
+			continue
+		}
+
+		if location != filepath.FromSlash(test.expected) {
+			t.Errorf("%s, %s: got %q, expected %q", test.template, test.name, location, test.expected)
+		}
+	}
+}
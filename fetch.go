@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// deviceResult is the outcome of fetching the information for a device.
+type deviceResult struct {
+	device      api.BaseDevice
+	information *api.Device
+	err         error
+}
+
+// fetchDevices retrieves the information for devices using apiWorkers concurrent requests.
+// Results are sent as they arrive, so they are not necessarily in the same order as devices.
+func fetchDevices(devices []api.BaseDevice) <-chan deviceResult {
+	workers := apiWorkers
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan api.BaseDevice)
+	results := make(chan deviceResult)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for device := range jobs {
+				information, err := fetchDeviceInformation(device.Identifier)
+
+				results <- deviceResult{device: device, information: information, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, device := range devices {
+			jobs <- device
+		}
+
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
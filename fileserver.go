@@ -0,0 +1,271 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+	"github.com/dustin/go-humanize"
+)
+
+// archiveFile is a downloaded firmware which is known to the catalog.
+type archiveFile struct {
+	Device   api.BaseDevice
+	Firmware api.Firmware
+
+	// RelPath is the slash separated path of the file relative to the archive root
+	RelPath string
+	Size    int64
+}
+
+// archiveIndex maps the files in the archive to their catalog entries.
+type archiveIndex struct {
+	built      time.Time
+	byPath     map[string]*archiveFile
+	byFirmware map[string]*archiveFile
+}
+
+func firmwareKey(identifier, firmwareURL string) string {
+	return identifier + " " + firmwareURL
+}
+
+// buildArchiveIndex finds every firmware in c which exists in the archive.
+func buildArchiveIndex(c *catalog) *archiveIndex {
+	index := &archiveIndex{
+		built:      time.Now(),
+		byPath:     make(map[string]*archiveFile),
+		byFirmware: make(map[string]*archiveFile),
+	}
+
+	root := archiveRoot()
+
+	for _, device := range c.Devices {
+		for _, fw := range device.Firmwares {
+			fw := fw
+
+			localPath, err := parseDownloadPath(&fw, &device.BaseDevice)
+
+			if err != nil {
+				continue
+			}
+
+			info, err := os.Stat(localPath)
+
+			if err != nil || info.IsDir() {
+				continue
+			}
+
+			rel, err := filepath.Rel(root, localPath)
+
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+
+			file := &archiveFile{
+				Device:   device.BaseDevice,
+				Firmware: fw,
+				RelPath:  filepath.ToSlash(rel),
+				Size:     info.Size(),
+			}
+
+			index.byPath[file.RelPath] = file
+			index.byFirmware[firmwareKey(device.Identifier, fw.URL)] = file
+		}
+	}
+
+	return index
+}
+
+// archiveIndexTTL is how long an archive index is used before checking the disk again.
+const archiveIndexTTL = time.Minute
+
+// archiveIndex returns an index of the archive, rebuilding it if it is out of date.
+func (s *apiServer) archiveIndex() *archiveIndex {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	if s.index == nil || time.Since(s.index.built) > archiveIndexTTL {
+		s.mu.RLock()
+		s.index = buildArchiveIndex(s.catalog)
+		s.mu.RUnlock()
+	}
+
+	return s.index
+}
+
+// serveFiles serves the firmwares in the archive, with directory listings following the
+// download directory template. Only files known to the catalog are served.
+func (s *apiServer) serveFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestPath := strings.Trim(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/files")), "/")
+
+	index := s.archiveIndex()
+
+	if file, ok := index.byPath[requestPath]; ok {
+		s.serveArchiveFile(w, r, file)
+		return
+	}
+
+	listing := listArchiveDirectory(index, requestPath)
+
+	if listing == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := directoryListingTemplate.Execute(w, listing); err != nil {
+		log.Printf("Unable to render directory listing, err: %s", err)
+	}
+}
+
+func (s *apiServer) serveArchiveFile(w http.ResponseWriter, r *http.Request, file *archiveFile) {
+	f, err := os.Open(filepath.Join(archiveRoot(), filepath.FromSlash(file.RelPath)))
+
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if file.Firmware.SHA1Sum != "" {
+		w.Header().Set("ETag", `"`+file.Firmware.SHA1Sum+`"`)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	// ServeContent handles HEAD, Range, If-Range and If-None-Match requests
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+type directoryEntry struct {
+	Name  string
+	Link  string
+	IsDir bool
+	File  *archiveFile
+}
+
+type directoryListing struct {
+	Path    string
+	Entries []directoryEntry
+}
+
+// listArchiveDirectory lists the files and directories directly inside directory, or returns nil
+// if no archived files exist within it.
+func listArchiveDirectory(index *archiveIndex, directory string) *directoryListing {
+	prefix := ""
+
+	if directory != "" {
+		prefix = directory + "/"
+	}
+
+	listing := &directoryListing{Path: "/" + prefix}
+	seenDirectories := make(map[string]bool)
+
+	for relPath, file := range index.byPath {
+		if !strings.HasPrefix(relPath, prefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(relPath, prefix)
+
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i]
+
+			if !seenDirectories[name] {
+				seenDirectories[name] = true
+
+				listing.Entries = append(listing.Entries, directoryEntry{
+					Name:  name + "/",
+					Link:  (&url.URL{Path: name}).EscapedPath() + "/",
+					IsDir: true,
+				})
+			}
+
+			continue
+		}
+
+		listing.Entries = append(listing.Entries, directoryEntry{
+			Name: name,
+			Link: (&url.URL{Path: name}).EscapedPath(),
+			File: file,
+		})
+	}
+
+	if len(listing.Entries) == 0 {
+		return nil
+	}
+
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		if listing.Entries[i].IsDir != listing.Entries[j].IsDir {
+			return listing.Entries[i].IsDir
+		}
+
+		return listing.Entries[i].Name < listing.Entries[j].Name
+	})
+
+	return listing
+}
+
+var directoryListingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"bytes": func(size int64) string {
+		return humanize.Bytes(uint64(size))
+	},
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+
+		return t.Format("2006-01-02")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{ .Path }}</title>
+</head>
+<body>
+<h1>Index of {{ .Path }}</h1>
+<table>
+<tr><th>Name</th><th>Device</th><th>Version</th><th>Build</th><th>Released</th><th>Size</th><th>SHA1</th></tr>
+{{- if ne .Path "/" }}
+<tr><td><a href="../">../</a></td></tr>
+{{- end }}
+{{- range .Entries }}
+{{- if .IsDir }}
+<tr><td><a href="{{ .Link }}">{{ .Name }}</a></td></tr>
+{{- else }}
+<tr><td><a href="{{ .Link }}">{{ .Name }}</a></td><td>{{ .File.Device.Name }}</td><td>{{ .File.Firmware.Version }}</td><td>{{ .File.Firmware.BuildID }}</td><td>{{ date .File.Firmware.ReleaseDate.Time }}</td><td>{{ bytes .File.Size }}</td><td><code>{{ .File.Firmware.SHA1Sum }}</code></td></tr>
+{{- end }}
+{{- end }}
+</table>
+</body>
+</html>
+`))
@@ -6,5 +6,5 @@ require (
 	github.com/dustin/go-humanize v0.0.0-20171111073723-bb3d318650d4
 	github.com/mattn/go-runewidth v0.0.2 // indirect
 	golang.org/x/sys v0.0.0-20180115085844-fff93fa7cd27 // indirect
-	gopkg.in/guregu/null.v3 v3.3.0 // indirect
+	gopkg.in/guregu/null.v3 v3.3.0
 )
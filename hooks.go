@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+const (
+	hookDownloadComplete = "on_download_complete"
+	hookVerifyFailed     = "on_verify_failed"
+	hookNewFirmware      = "on_new_firmware"
+	hookSigningChange    = "on_signing_change"
+)
+
+var (
+	hookFlags   stringFlags
+	hookTimeout time.Duration
+	hookRetries int
+
+	hooks        map[string][]string
+	pendingHooks sync.WaitGroup
+
+	// webhookClient has the same proxy, TLS and timeout settings as httpClient, but does not send the
+	// -header values, which are meant for download hosts.
+	webhookClient *http.Client
+)
+
+// hookEvent is the payload sent to webhooks, and exposed to commands as ATF_PAYLOAD.
+type hookEvent struct {
+	Event    string          `json:"event"`
+	Time     time.Time       `json:"time"`
+	Device   *api.BaseDevice `json:"device,omitempty"`
+	Firmware *api.Firmware   `json:"firmware,omitempty"`
+	Path     string          `json:"path,omitempty"`
+	Checksum string          `json:"checksum,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// parseHooks parses -hook flags of the form event=target, where target is a webhook URL or a command.
+func parseHooks(flags []string) (map[string][]string, error) {
+	parsed := make(map[string][]string)
+
+	for _, hook := range flags {
+		parts := strings.SplitN(hook, "=", 2)
+
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid hook: %s (expected event=url or event=command)", hook)
+		}
+
+		switch parts[0] {
+		case hookDownloadComplete, hookVerifyFailed, hookNewFirmware, hookSigningChange:
+			parsed[parts[0]] = append(parsed[parts[0]], parts[1])
+		default:
+			return nil, fmt.Errorf("unknown hook event: %s", parts[0])
+		}
+	}
+
+	return parsed, nil
+}
+
+// fireHook runs every hook registered for event.Event in the background.
+func fireHook(event hookEvent) {
+	targets := hooks[event.Event]
+
+	if len(targets) == 0 {
+		return
+	}
+
+	event.Time = time.Now()
+
+	payload, err := json.Marshal(event)
+
+	if err != nil {
+		log.Printf("Unable to encode %s hook payload, err: %s", event.Event, err)
+		return
+	}
+
+	for _, target := range targets {
+		pendingHooks.Add(1)
+
+		go func(target string) {
+			defer pendingHooks.Done()
+
+			var err error
+
+			for attempt := 0; attempt <= hookRetries; attempt++ {
+				if attempt > 0 {
+					time.Sleep(time.Duration(attempt) * 5 * time.Second)
+				}
+
+				if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+					err = postWebhook(target, payload)
+				} else {
+					err = runHookCommand(target, event, payload)
+				}
+
+				if err == nil {
+					return
+				}
+
+				log.Printf("Hook %s (%s) failed, err: %s", event.Event, target, err)
+			}
+		}(target)
+	}
+}
+
+// waitForHooks blocks until all hooks which have been fired have finished.
+func waitForHooks() {
+	pendingHooks.Wait()
+}
+
+func postWebhook(url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func runHookCommand(command string, event hookEvent, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+
+	cmd.Env = append(os.Environ(), hookEnvironment(event, payload)...)
+	// stdout may be the -output json event stream
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+func hookEnvironment(event hookEvent, payload []byte) []string {
+	env := []string{
+		"ATF_EVENT=" + event.Event,
+		"ATF_PAYLOAD=" + string(payload),
+	}
+
+	if event.Device != nil {
+		env = append(env,
+			"ATF_DEVICE_IDENTIFIER="+event.Device.Identifier,
+			"ATF_DEVICE_NAME="+event.Device.Name,
+		)
+	}
+
+	if event.Firmware != nil {
+		env = append(env,
+			"ATF_VERSION="+event.Firmware.Version,
+			"ATF_BUILDID="+event.Firmware.BuildID,
+			"ATF_URL="+event.Firmware.URL,
+			"ATF_SHA1="+event.Firmware.SHA1Sum,
+			"ATF_SIGNED="+strconv.FormatBool(event.Firmware.Signed),
+		)
+	}
+
+	if event.Path != "" {
+		env = append(env, "ATF_PATH="+event.Path)
+	}
+
+	if event.Checksum != "" {
+		env = append(env, "ATF_CHECKSUM="+event.Checksum)
+	}
+
+	if event.Error != "" {
+		env = append(env, "ATF_ERROR="+event.Error)
+	}
+
+	return env
+}
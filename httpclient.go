@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpOptions configures the HTTP client shared by the API client and the firmware downloader.
+type httpOptions struct {
+	connectTimeout time.Duration
+	idleTimeout    time.Duration
+	stallTimeout   time.Duration
+	proxy          string
+	caFile         string
+	insecure       bool
+	userAgent      string
+	headers        headerFlags
+}
+
+// headerFlags collects repeated "Name: value" flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("invalid header: %s (expected \"Name: value\")", value)
+	}
+
+	*h = append(*h, value)
+
+	return nil
+}
+
+func (h headerFlags) header() http.Header {
+	header := make(http.Header)
+
+	for _, value := range h {
+		parts := strings.SplitN(value, ":", 2)
+
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	return header
+}
+
+// newHTTPClient builds an *http.Client from the given options.
+func newHTTPClient(opts httpOptions) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   opts.connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: opts.insecure,
+	}
+
+	if opts.caFile != "" {
+		pem, err := ioutil.ReadFile(opts.caFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.caFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	proxy := http.ProxyFromEnvironment
+
+	if opts.proxy != "" {
+		proxyURL, err := url.Parse(opts.proxy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   opts.connectTimeout,
+		ResponseHeaderTimeout: opts.stallTimeout,
+		IdleConnTimeout:       opts.idleTimeout,
+		MaxIdleConns:          100,
+	}
+
+	return &http.Client{
+		Transport: &clientTransport{
+			transport:    transport,
+			userAgent:    opts.userAgent,
+			headers:      opts.headers.header(),
+			stallTimeout: opts.stallTimeout,
+		},
+	}, nil
+}
+
+// clientTransport adds the configured headers to every request and aborts responses
+// which stop sending data for longer than stallTimeout.
+type clientTransport struct {
+	transport    http.RoundTripper
+	userAgent    string
+	headers      http.Header
+	stallTimeout time.Duration
+}
+
+func (t *clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+
+	req = req.Clone(ctx)
+
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+
+	for key, values := range t.headers {
+		req.Header[key] = values
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if t.stallTimeout <= 0 {
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+
+	resp.Body = newStallReader(resp.Body, t.stallTimeout, cancel)
+
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+
+	return c.ReadCloser.Close()
+}
+
+var errStalled = errors.New("connection stalled")
+
+// stallReader cancels the request if a single Read blocks for longer than timeout. Time spent
+// between reads (e.g. waiting on the rate limiter) does not count towards the timeout.
+type stallReader struct {
+	io.ReadCloser
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	timeout time.Duration
+	stalled bool
+	cancel  context.CancelFunc
+}
+
+func newStallReader(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *stallReader {
+	r := &stallReader{
+		ReadCloser: body,
+		timeout:    timeout,
+		cancel:     cancel,
+	}
+
+	r.timer = time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		r.stalled = true
+		r.mu.Unlock()
+
+		cancel()
+	})
+
+	r.timer.Stop()
+
+	return r
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+
+	n, err := r.ReadCloser.Read(p)
+
+	r.timer.Stop()
+
+	r.mu.Lock()
+	stalled := r.stalled
+	r.mu.Unlock()
+
+	if stalled && err != nil && err != io.EOF {
+		return n, fmt.Errorf("%w: no data received for %s", errStalled, r.timeout)
+	}
+
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	defer r.cancel()
+
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// img3 is a firmware image in the container format used before IMG4.
+type img3 struct {
+	Type  string
+	Data  []byte
+	KBags []imageKBag
+}
+
+const img3HeaderSize = 20
+
+var errNotIMG3 = errors.New("not an IMG3")
+
+// img3Tag returns the four character code of an IMG3 header or tag, which are stored reversed.
+func img3Tag(b []byte) string {
+	return string([]byte{b[3], b[2], b[1], b[0]})
+}
+
+// parseIMG3 parses an IMG3 image and its DATA, TYPE and KBAG tags.
+func parseIMG3(b []byte) (*img3, error) {
+	if len(b) < img3HeaderSize || img3Tag(b) != "Img3" {
+		return nil, errNotIMG3
+	}
+
+	size := binary.LittleEndian.Uint32(b[4:])
+
+	if size < img3HeaderSize {
+		return nil, fmt.Errorf("invalid IMG3 size: %d", size)
+	}
+
+	if uint64(size) > uint64(len(b)) {
+		return nil, errors.New("truncated IMG3")
+	}
+
+	img := &img3{Type: img3Tag(b[16:])}
+
+	for rest := b[img3HeaderSize:size]; len(rest) >= 12; {
+		tag := img3Tag(rest)
+		totalLength := binary.LittleEndian.Uint32(rest[4:])
+		dataLength := binary.LittleEndian.Uint32(rest[8:])
+
+		if totalLength < 12 || uint64(totalLength) > uint64(len(rest)) || uint64(dataLength) > uint64(totalLength-12) {
+			return nil, fmt.Errorf("invalid IMG3 tag: %s", tag)
+		}
+
+		data := rest[12 : 12+dataLength]
+
+		switch tag {
+		case "DATA":
+			img.Data = data
+		case "TYPE":
+			if len(data) >= 4 {
+				img.Type = img3Tag(data)
+			}
+		case "KBAG":
+			// crypt state, AES key size in bits, IV, key
+			if len(data) < 8+16 {
+				return nil, errors.New("invalid IMG3 KBAG")
+			}
+
+			keySize := binary.LittleEndian.Uint32(data[4:]) / 8
+
+			if uint64(len(data)) < 8+16+uint64(keySize) {
+				return nil, errors.New("invalid IMG3 KBAG")
+			}
+
+			img.KBags = append(img.KBags, imageKBag{
+				Type: int(binary.LittleEndian.Uint32(data)),
+				IV:   data[8:24],
+				Key:  data[24 : 24+keySize],
+			})
+		}
+
+		rest = rest[totalLength:]
+	}
+
+	if img.Data == nil {
+		return nil, errors.New("IMG3 has no DATA tag")
+	}
+
+	return img, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// img3Bytes builds an IMG3 with the given type and tags, whose four character codes are written reversed.
+func img3Bytes(imageType string, tags ...[]byte) []byte {
+	reversed := func(s string) []byte {
+		return []byte{s[3], s[2], s[1], s[0]}
+	}
+
+	var body []byte
+
+	for _, tag := range tags {
+		body = append(body, tag...)
+	}
+
+	b := reversed("Img3")
+	b = append(b, le32(uint32(img3HeaderSize+len(body)))...)
+	b = append(b, le32(uint32(len(body)))...)
+	b = append(b, le32(uint32(len(body)))...)
+	b = append(b, reversed(imageType)...)
+
+	return append(b, body...)
+}
+
+func le32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, n)
+
+	return b
+}
+
+func img3TagBytes(tag string, data []byte) []byte {
+	b := []byte{tag[3], tag[2], tag[1], tag[0]}
+	b = append(b, le32(uint32(12+len(data)))...)
+	b = append(b, le32(uint32(len(data)))...)
+
+	return append(b, data...)
+}
+
+func TestParseIMG3(t *testing.T) {
+	iv := bytes.Repeat([]byte{1}, 16)
+	key := bytes.Repeat([]byte{2}, 32)
+
+	kbag := le32(1)
+	kbag = append(kbag, le32(256)...)
+	kbag = append(kbag, iv...)
+	kbag = append(kbag, key...)
+
+	img, err := parseIMG3(img3Bytes("illb",
+		img3TagBytes("TYPE", []byte("ssbi")),
+		img3TagBytes("DATA", []byte("payload")),
+		img3TagBytes("KBAG", kbag),
+	))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Type != "ibss" {
+		t.Errorf("got type %q, expected %q", img.Type, "ibss")
+	}
+
+	if string(img.Data) != "payload" {
+		t.Errorf("got data %q, expected %q", img.Data, "payload")
+	}
+
+	if len(img.KBags) != 1 || img.KBags[0].Type != 1 || !bytes.Equal(img.KBags[0].IV, iv) || !bytes.Equal(img.KBags[0].Key, key) {
+		t.Errorf("got KBAGs %+v", img.KBags)
+	}
+}
+
+func TestParseInvalidIMG3(t *testing.T) {
+	valid := img3Bytes("illb", img3TagBytes("DATA", []byte("payload")))
+
+	withSize := func(size uint32) []byte {
+		b := append([]byte(nil), valid...)
+		binary.LittleEndian.PutUint32(b[4:], size)
+
+		return b
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"not img3", []byte("not an img3 image at all")},
+		{"size smaller than header", withSize(4)},
+		{"size larger than data", withSize(uint32(len(valid) + 1))},
+		{"truncated tag", valid[:len(valid)-1]},
+		{"tag length too small", img3Bytes("illb", []byte("ATAD\x04\x00\x00\x00\x00\x00\x00\x00"))},
+		{"tag data longer than tag", img3Bytes("illb", []byte("ATAD\x0c\x00\x00\x00\x01\x00\x00\x00"))},
+		{"short kbag", img3Bytes("illb", img3TagBytes("DATA", nil), img3TagBytes("KBAG", make([]byte, 8)))},
+		{"no data", img3Bytes("illb")},
+	}
+
+	for _, test := range tests {
+		if _, err := parseIMG3(test.b); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// im4p is an IMG4 payload: a firmware image, optionally encrypted and compressed.
+type im4p struct {
+	Type        string
+	Description string
+	Data        []byte
+	KBags       []imageKBag
+}
+
+// imageKBag is an encrypted key and IV for an image's payload. Type 1 is for production devices,
+// type 2 for development.
+type imageKBag struct {
+	Type int
+	IV   []byte
+	Key  []byte
+}
+
+var errNotIM4P = errors.New("not an IM4P")
+
+// parseIM4P parses an IM4P, or the IM4P inside an IMG4.
+func parseIM4P(b []byte) (*im4p, error) {
+	fields, err := asn1Sequence(b)
+
+	if err != nil || len(fields) == 0 {
+		return nil, errNotIM4P
+	}
+
+	var magic string
+
+	if _, err := asn1.UnmarshalWithParams(fields[0].FullBytes, &magic, "ia5"); err != nil {
+		return nil, errNotIM4P
+	}
+
+	if magic == "IMG4" {
+		if len(fields) < 2 {
+			return nil, errNotIM4P
+		}
+
+		return parseIM4P(fields[1].FullBytes)
+	}
+
+	if magic != "IM4P" || len(fields) < 4 {
+		return nil, errNotIM4P
+	}
+
+	p := &im4p{}
+
+	if _, err := asn1.UnmarshalWithParams(fields[1].FullBytes, &p.Type, "ia5"); err != nil {
+		return nil, fmt.Errorf("invalid IM4P type: %s", err)
+	}
+
+	if _, err := asn1.UnmarshalWithParams(fields[2].FullBytes, &p.Description, "ia5"); err != nil {
+		return nil, fmt.Errorf("invalid IM4P description: %s", err)
+	}
+
+	if _, err := asn1.Unmarshal(fields[3].FullBytes, &p.Data); err != nil {
+		return nil, fmt.Errorf("invalid IM4P payload: %s", err)
+	}
+
+	// the KBAG is an OCTET STRING containing a DER encoded SEQUENCE of (type, iv, key)
+	if len(fields) > 4 && fields[4].Class == asn1.ClassUniversal && fields[4].Tag == asn1.TagOctetString {
+		var kbags []struct {
+			Type int
+			IV   []byte
+			Key  []byte
+		}
+
+		if _, err := asn1.Unmarshal(fields[4].Bytes, &kbags); err != nil {
+			return nil, fmt.Errorf("invalid IM4P KBAG: %s", err)
+		}
+
+		for _, kbag := range kbags {
+			p.KBags = append(p.KBags, imageKBag(kbag))
+		}
+	}
+
+	return p, nil
+}
+
+// asn1Sequence returns the elements of the DER encoded SEQUENCE in b.
+func asn1Sequence(b []byte) ([]asn1.RawValue, error) {
+	var sequence asn1.RawValue
+
+	if _, err := asn1.Unmarshal(b, &sequence); err != nil {
+		return nil, err
+	}
+
+	if sequence.Class != asn1.ClassUniversal || sequence.Tag != asn1.TagSequence {
+		return nil, errors.New("not a SEQUENCE")
+	}
+
+	var fields []asn1.RawValue
+
+	for rest := sequence.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+
+		var err error
+
+		rest, err = asn1.Unmarshal(rest, &field)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// imageNames maps IMG3 and IM4P types to the image names used for keys by the API.
+var imageNames = map[string]string{
+	"krnl": "Kernelcache",
+	"ibot": "iBoot",
+	"ibec": "iBEC",
+	"ibss": "iBSS",
+	"illb": "LLB",
+	"dtre": "DeviceTree",
+	"sepi": "SEPFirmware",
+	"rdsk": "RestoreRamDisk",
+	"logo": "AppleLogo",
+	"recm": "RecoveryMode",
+	"bat0": "BatteryLow0",
+	"bat1": "BatteryLow1",
+	"batF": "BatteryFull",
+	"chg0": "BatteryCharging0",
+	"chg1": "BatteryCharging1",
+	"glyP": "GlyphPlugin",
+}
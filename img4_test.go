@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"testing"
+)
+
+type testKBag struct {
+	Type int
+	IV   []byte
+	Key  []byte
+}
+
+// im4pBytes builds an IM4P, with a KBAG if kbags is not empty.
+func im4pBytes(t *testing.T, imageType string, data []byte, kbags []testKBag) []byte {
+	fields := []interface{}{"IM4P", imageType, "test image", data}
+
+	if len(kbags) > 0 {
+		kbag, err := asn1.Marshal(kbags)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields = append(fields, kbag)
+	}
+
+	var content []byte
+
+	for _, field := range fields {
+		var b []byte
+		var err error
+
+		if s, ok := field.(string); ok {
+			b, err = asn1.MarshalWithParams(s, "ia5")
+		} else {
+			b, err = asn1.Marshal(field)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content = append(content, b...)
+	}
+
+	b, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: content})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestParseIM4P(t *testing.T) {
+	kbags := []testKBag{
+		{Type: 1, IV: bytes.Repeat([]byte{1}, 16), Key: bytes.Repeat([]byte{2}, 32)},
+		{Type: 2, IV: bytes.Repeat([]byte{3}, 16), Key: bytes.Repeat([]byte{4}, 32)},
+	}
+
+	im4p := im4pBytes(t, "krnl", []byte("payload"), kbags)
+
+	magic, err := asn1.MarshalWithParams("IMG4", "ia5")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img4, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: append(magic, im4p...)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		b     []byte
+		kbags int
+	}{
+		{"im4p", im4p, 2},
+		{"img4", img4, 2},
+		{"unencrypted", im4pBytes(t, "krnl", []byte("payload"), nil), 0},
+	}
+
+	for _, test := range tests {
+		p, err := parseIM4P(test.b)
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if p.Type != "krnl" || p.Description != "test image" || string(p.Data) != "payload" {
+			t.Errorf("%s: got %q, %q, %q", test.name, p.Type, p.Description, p.Data)
+		}
+
+		if len(p.KBags) != test.kbags {
+			t.Errorf("%s: got %d KBAGs, expected %d", test.name, len(p.KBags), test.kbags)
+			continue
+		}
+
+		for i, kbag := range p.KBags {
+			if kbag.Type != kbags[i].Type || !bytes.Equal(kbag.IV, kbags[i].IV) || !bytes.Equal(kbag.Key, kbags[i].Key) {
+				t.Errorf("%s: got KBAG %+v, expected %+v", test.name, kbag, kbags[i])
+			}
+		}
+	}
+}
+
+func TestParseInvalidIM4P(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"not asn1", []byte("not an image")},
+		{"img3", img3Bytes("illb", img3TagBytes("DATA", nil))},
+		{"truncated", im4pBytes(t, "krnl", []byte("payload"), nil)[:10]},
+	}
+
+	for _, test := range tests {
+		if _, err := parseIM4P(test.b); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// Ways of bringing a file into the archive.
+const (
+	importCopy    = "copy"
+	importMove    = "move"
+	importLink    = "link"
+	importSymlink = "symlink"
+)
+
+// libraryFirmware is a firmware for a specific device.
+type libraryFirmware struct {
+	device   api.BaseDevice
+	firmware api.Firmware
+}
+
+// importFirmwares finds IPSWs in the given directories and brings the ones which are recognised into
+// the archive, at the location they would have been downloaded to.
+func importFirmwares(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+
+	mode := flags.String("mode", importCopy, "how to bring files into the archive: copy, move, link (hard link) or symlink")
+	dryRun := flags.Bool("dry-run", false, "only report what would be imported")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] import [import flags] directory...\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	switch *mode {
+	case importCopy, importMove, importLink, importSymlink:
+	default:
+		log.Fatalf("Unknown import mode: %s", *mode)
+	}
+
+	log.Printf("Gathering IPSW information...")
+
+	c, _, err := fetchCatalog(specifiedDevice)
+
+	if err != nil {
+		log.Fatalf("Unable to retrieve firmware information, err: %s", err)
+	}
+
+	bySHA1 := make(map[string][]libraryFirmware)
+	byBuild := make(map[string][]libraryFirmware)
+
+	for _, device := range c.Devices {
+		for _, fw := range selectFirmwares(device) {
+			firmware := libraryFirmware{device: device.BaseDevice, firmware: fw}
+
+			if fw.SHA1Sum != "" {
+				bySHA1[fw.SHA1Sum] = append(bySHA1[fw.SHA1Sum], firmware)
+			}
+
+			byBuild[device.Identifier+" "+fw.BuildID] = append(byBuild[device.Identifier+" "+fw.BuildID], firmware)
+		}
+	}
+
+	var candidates []importCandidate
+	var unrecognised []string
+
+	failed := 0
+
+	for _, root := range flags.Args() {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Printf("Unable to read: %s, err: %s", path, err)
+				return nil
+			}
+
+			if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".ipsw") {
+				return nil
+			}
+
+			checksum, err := fileSHA1(path)
+
+			if err != nil {
+				log.Printf("Unable to read: %s, err: %s", path, err)
+				failed++
+				return nil
+			}
+
+			candidate := importCandidate{path: path, checksum: checksum}
+
+			candidate.matches, candidate.exact, err = identifyIPSW(path, checksum, bySHA1, byBuild)
+
+			if err != nil {
+				log.Printf("Unable to identify: %s, err: %s", path, err)
+			}
+
+			if len(candidate.matches) == 0 {
+				unrecognised = append(unrecognised, path)
+				return nil
+			}
+
+			candidates = append(candidates, candidate)
+
+			return nil
+		})
+
+		if err != nil {
+			log.Printf("Unable to scan: %s, err: %s", root, err)
+			failed++
+		}
+	}
+
+	// files matching the API's SHA1 take precedence over those only matching by their manifests
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].exact && !candidates[j].exact
+	})
+
+	imported, existing := 0, 0
+
+	for _, candidate := range candidates {
+		placed, err := importIPSW(candidate.path, candidate.checksum, candidate.matches, *mode, *dryRun)
+
+		if err != nil {
+			log.Printf("Unable to import: %s, err: %s", candidate.path, err)
+			failed++
+		} else if placed > 0 {
+			imported++
+		} else {
+			existing++
+		}
+	}
+
+	log.Printf("Imported: %d, already in the archive: %d, unrecognised: %d, failed: %d", imported, existing, len(unrecognised), failed)
+
+	if len(unrecognised) > 0 {
+		log.Printf("Unrecognised files:")
+
+		for _, path := range unrecognised {
+			log.Printf("  %s", path)
+		}
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// importCandidate is a file which has been recognised as one or more firmwares.
+type importCandidate struct {
+	path     string
+	checksum string
+	matches  []libraryFirmware
+
+	// exact is whether the file matched by its SHA1, rather than its manifests
+	exact bool
+}
+
+// identifyIPSW returns the firmwares an IPSW is, by its SHA1 or, failing that, by the device and
+// build in its manifests if the IPSW is intact. exact is whether it matched by SHA1.
+func identifyIPSW(path, checksum string, bySHA1, byBuild map[string][]libraryFirmware) (matches []libraryFirmware, exact bool, err error) {
+	if matches := bySHA1[checksum]; len(matches) > 0 {
+		return matches, true, nil
+	}
+
+	z, err := zip.OpenReader(path)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer z.Close()
+
+	info, err := inspectIPSW(&z.Reader)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, build := info.version()
+
+	for _, productType := range info.productTypes() {
+		for _, firmware := range byBuild[productType+" "+build] {
+			if firmware.firmware.SHA1Sum != "" {
+				log.Printf("%s matches %s %s by its manifest, but not its SHA1", path, firmware.device.Identifier, build)
+			}
+
+			matches = append(matches, firmware)
+		}
+	}
+
+	// the matches come from the manifests, so only the zip itself needs checking, once for all of them
+	if len(matches) > 0 {
+		if err := verifyZipMembers(&z.Reader); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return matches, false, nil
+}
+
+// importIPSW brings the IPSW at path into the archive for each firmware it matches, returning how many
+// locations it was placed at. The first location is imported using mode, further locations (e.g. for
+// other devices) are copies or links of the first.
+func importIPSW(path, checksum string, matches []libraryFirmware, mode string, dryRun bool) (int, error) {
+	source := path
+	seen := make(map[string]bool)
+	placed := 0
+
+	for _, match := range matches {
+		location, err := parseDownloadPath(&match.firmware, &match.device)
+
+		if err != nil {
+			return placed, err
+		}
+
+		directory := filepath.Dir(location)
+
+		if seen[location] {
+			continue
+		}
+
+		seen[location] = true
+
+		if _, err := os.Stat(location); err == nil {
+			log.Printf("%s is already in the archive at %s", path, location)
+			continue
+		}
+
+		if dryRun {
+			log.Printf("Would %s %s to %s", mode, path, location)
+			placed++
+			continue
+		}
+
+		if err := os.MkdirAll(directory, 0700); err != nil {
+			return placed, err
+		}
+
+		fileMode := mode
+
+		// the source has been moved, so copy (or link) from where it is now
+		if source != path && mode == importMove {
+			fileMode = importCopy
+		}
+
+		if fileMode == importCopy || fileMode == importMove {
+			if info, err := os.Stat(source); err == nil {
+				if err := ensureFreeSpace(directory, uint64(info.Size())); err != nil {
+					return placed, err
+				}
+			}
+		}
+
+		log.Printf("Importing %s to %s (%s)", path, location, fileMode)
+
+		if err := placeFile(source, location, fileMode); err != nil {
+			return placed, err
+		}
+
+		placed++
+
+		if mode == importMove {
+			source = location
+		}
+
+		writeDownloadMetadata(&match.device, &match.firmware, location, path, checksum)
+	}
+
+	return placed, nil
+}
+
+// placeFile copies, moves or links source to destination.
+func placeFile(source, destination, mode string) error {
+	switch mode {
+	case importMove:
+		if err := os.Rename(source, destination); err == nil {
+			return nil
+		}
+
+		// probably a different filesystem
+		if err := copyFile(source, destination); err != nil {
+			return err
+		}
+
+		return os.Remove(source)
+
+	case importLink:
+		return os.Link(source, destination)
+
+	case importSymlink:
+		absolute, err := filepath.Abs(source)
+
+		if err != nil {
+			return err
+		}
+
+		return os.Symlink(absolute, destination)
+	}
+
+	return copyFile(source, destination)
+}
+
+// copyFile copies source to destination, under a temporary name until it is complete.
+func copyFile(source, destination string) error {
+	in, err := os.Open(source)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	tmp := destination + ".part"
+
+	out, err := os.Create(tmp)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, destination)
+}
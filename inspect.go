@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+)
+
+// inspect prints the manifests and contents of IPSW files.
+func inspect(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+
+	showFiles := flags.Bool("files", true, "list the files in the IPSW")
+	showComponents := flags.Bool("components", true, "list the components of each build identity")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s inspect [flags] file.ipsw...\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+
+	for _, path := range flags.Args() {
+		info, err := inspectIPSWFile(path)
+
+		if err != nil {
+			log.Printf("Unable to inspect: %s, err: %s", path, err)
+			failed = true
+			continue
+		}
+
+		if outputFormat == outputJSON {
+			b, err := json.Marshal(info)
+
+			if err != nil {
+				log.Fatalf("Unable to encode IPSW information, err: %s", err)
+			}
+
+			fmt.Println(string(b))
+			continue
+		}
+
+		printIPSWInfo(info, *showComponents, *showFiles)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// inspectIPSWFile reads the manifests and file listing of a local IPSW.
+func inspectIPSWFile(path string) (*ipswInfo, error) {
+	z, err := zip.OpenReader(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer z.Close()
+
+	info, err := inspectIPSW(&z.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info.Path = path
+
+	return info, nil
+}
+
+func printIPSWInfo(info *ipswInfo, showComponents, showFiles bool) {
+	version, build := info.version()
+
+	fmt.Println(info.Path)
+	fmt.Printf("  Version:  %s (%s)\n", version, build)
+	fmt.Printf("  Devices:  %s\n", strings.Join(info.productTypes(), ", "))
+
+	if info.Restore != nil && len(info.Restore.BoardConfigs) > 0 {
+		fmt.Printf("  Boards:   %s\n", strings.Join(info.Restore.BoardConfigs, ", "))
+	}
+
+	if info.BuildManifest != nil {
+		for _, identity := range info.BuildManifest.BuildIdentities {
+			fmt.Println()
+			fmt.Printf("  Build identity: %s", identity.DeviceClass)
+
+			if identity.Variant != "" {
+				fmt.Printf(" (%s)", identity.Variant)
+			}
+
+			fmt.Println()
+
+			if !showComponents {
+				continue
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+			for _, component := range identity.Components {
+				fmt.Fprintf(w, "    %s\t%s\t%s\n", component.Name, component.Path, component.Digest)
+			}
+
+			w.Flush()
+		}
+	}
+
+	if showFiles {
+		fmt.Println()
+		fmt.Println("  Files:")
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+		for _, file := range info.Files {
+			fmt.Fprintf(w, "    %s\t  %s\n", humanize.Bytes(file.Size), file.Name)
+		}
+
+		w.Flush()
+	}
+
+	fmt.Println()
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// ipswInfo describes the contents of an IPSW.
+type ipswInfo struct {
+	Path          string         `json:"path"`
+	BuildManifest *buildManifest `json:"build_manifest,omitempty"`
+	Restore       *restoreInfo   `json:"restore,omitempty"`
+	Files         []ipswFile     `json:"files"`
+}
+
+// buildManifest is the interesting parts of an IPSW's BuildManifest.plist.
+type buildManifest struct {
+	ProductVersion        string          `json:"product_version"`
+	ProductBuildVersion   string          `json:"product_build_version"`
+	SupportedProductTypes []string        `json:"supported_product_types"`
+	BuildIdentities       []buildIdentity `json:"build_identities"`
+}
+
+// buildIdentity is a set of components used to restore a class of device.
+type buildIdentity struct {
+	DeviceClass string              `json:"device_class"`
+	Variant     string              `json:"variant,omitempty"`
+	BuildNumber string              `json:"build_number,omitempty"`
+	ChipID      string              `json:"chip_id,omitempty"`
+	BoardID     string              `json:"board_id,omitempty"`
+	Components  []manifestComponent `json:"components"`
+}
+
+// manifestComponent is a firmware image listed in a build identity.
+type manifestComponent struct {
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// restoreInfo is the interesting parts of an IPSW's Restore.plist.
+type restoreInfo struct {
+	ProductVersion        string   `json:"product_version"`
+	ProductBuildVersion   string   `json:"product_build_version"`
+	ProductType           string   `json:"product_type,omitempty"`
+	SupportedProductTypes []string `json:"supported_product_types,omitempty"`
+	DeviceClass           string   `json:"device_class,omitempty"`
+	BoardConfigs          []string `json:"board_configs,omitempty"`
+}
+
+// ipswFile is a member of an IPSW.
+type ipswFile struct {
+	Name           string `json:"name"`
+	Size           uint64 `json:"size"`
+	CompressedSize uint64 `json:"compressed_size"`
+}
+
+// inspectIPSW reads the manifests and file listing of an IPSW. Either manifest may be missing,
+// e.g. early firmwares have no BuildManifest.plist.
+func inspectIPSW(z *zip.Reader) (*ipswInfo, error) {
+	info := &ipswInfo{}
+
+	var err error
+
+	info.BuildManifest, err = parseBuildManifest(z)
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	info.Restore, err = parseRestorePlist(z)
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		info.Files = append(info.Files, ipswFile{
+			Name:           f.Name,
+			Size:           f.UncompressedSize64,
+			CompressedSize: f.CompressedSize64,
+		})
+	}
+
+	return info, nil
+}
+
+// readZipPlist decodes the property list at name in a zip file.
+func readZipPlist(z *zip.Reader, name string) (map[string]interface{}, error) {
+	r, err := z.Open(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(r, 64<<20))
+
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := decodePlist(b)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	dict, ok := value.(map[string]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("%s: not a dictionary", name)
+	}
+
+	return dict, nil
+}
+
+// parseBuildManifest reads BuildManifest.plist from an IPSW.
+func parseBuildManifest(z *zip.Reader) (*buildManifest, error) {
+	plist, err := readZipPlist(z, "BuildManifest.plist")
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &buildManifest{
+		ProductVersion:        plistString(plist, "ProductVersion"),
+		ProductBuildVersion:   plistString(plist, "ProductBuildVersion"),
+		SupportedProductTypes: plistStrings(plist, "SupportedProductTypes"),
+	}
+
+	identities, _ := plist["BuildIdentities"].([]interface{})
+
+	for _, value := range identities {
+		identity, ok := value.(map[string]interface{})
+
+		if !ok {
+			continue
+		}
+
+		info := plistDict(identity, "Info")
+
+		b := buildIdentity{
+			DeviceClass: plistString(info, "DeviceClass"),
+			Variant:     plistString(info, "Variant"),
+			BuildNumber: plistString(info, "BuildNumber"),
+			ChipID:      plistString(identity, "ApChipID"),
+			BoardID:     plistString(identity, "ApBoardID"),
+		}
+
+		for name, value := range plistDict(identity, "Manifest") {
+			component, ok := value.(map[string]interface{})
+
+			if !ok {
+				continue
+			}
+
+			c := manifestComponent{
+				Name: name,
+				Path: plistString(plistDict(component, "Info"), "Path"),
+			}
+
+			if digest, ok := component["Digest"].([]byte); ok {
+				c.Digest = hex.EncodeToString(digest)
+			}
+
+			b.Components = append(b.Components, c)
+		}
+
+		sort.Slice(b.Components, func(i, j int) bool {
+			return b.Components[i].Name < b.Components[j].Name
+		})
+
+		manifest.BuildIdentities = append(manifest.BuildIdentities, b)
+	}
+
+	return manifest, nil
+}
+
+// parseRestorePlist reads Restore.plist from an IPSW.
+func parseRestorePlist(z *zip.Reader) (*restoreInfo, error) {
+	plist, err := readZipPlist(z, "Restore.plist")
+
+	if err != nil {
+		return nil, err
+	}
+
+	restore := &restoreInfo{
+		ProductVersion:        plistString(plist, "ProductVersion"),
+		ProductBuildVersion:   plistString(plist, "ProductBuildVersion"),
+		ProductType:           plistString(plist, "ProductType"),
+		SupportedProductTypes: plistStrings(plist, "SupportedProductTypes"),
+		DeviceClass:           plistString(plist, "DeviceClass"),
+	}
+
+	deviceMap, _ := plist["DeviceMap"].([]interface{})
+
+	for _, value := range deviceMap {
+		if device, ok := value.(map[string]interface{}); ok {
+			if boardConfig := plistString(device, "BoardConfig"); boardConfig != "" {
+				restore.BoardConfigs = append(restore.BoardConfigs, boardConfig)
+			}
+		}
+	}
+
+	return restore, nil
+}
+
+// productTypes returns the devices an IPSW supports, according to whichever manifest it has.
+func (info *ipswInfo) productTypes() []string {
+	if info.BuildManifest != nil && len(info.BuildManifest.SupportedProductTypes) > 0 {
+		return info.BuildManifest.SupportedProductTypes
+	}
+
+	if info.Restore != nil {
+		if len(info.Restore.SupportedProductTypes) > 0 {
+			return info.Restore.SupportedProductTypes
+		}
+
+		if info.Restore.ProductType != "" {
+			return []string{info.Restore.ProductType}
+		}
+	}
+
+	return nil
+}
+
+// version returns the product version and build of an IPSW, according to whichever manifest it has.
+func (info *ipswInfo) version() (version, build string) {
+	if info.BuildManifest != nil && info.BuildManifest.ProductBuildVersion != "" {
+		return info.BuildManifest.ProductVersion, info.BuildManifest.ProductBuildVersion
+	}
+
+	if info.Restore != nil {
+		return info.Restore.ProductVersion, info.Restore.ProductBuildVersion
+	}
+
+	return "", ""
+}
+
+// verifyIPSWStructure checks that an IPSW is intact without relying on its checksum: the zip central
+// directory must be readable, every member must decompress and match its CRC32, and the manifests must
+// describe the expected device and build.
+func verifyIPSWStructure(path string, device *api.BaseDevice, ipsw *api.Firmware) error {
+	z, err := zip.OpenReader(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer z.Close()
+
+	if err := verifyZipMembers(&z.Reader); err != nil {
+		return err
+	}
+
+	info, err := inspectIPSW(&z.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	if info.BuildManifest == nil && info.Restore == nil {
+		return errors.New("no BuildManifest.plist or Restore.plist")
+	}
+
+	if _, build := info.version(); build != ipsw.BuildID {
+		return fmt.Errorf("manifest is for build %s, expected %s", build, ipsw.BuildID)
+	}
+
+	for _, productType := range info.productTypes() {
+		if productType == device.Identifier {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("manifest is for %s, expected %s", strings.Join(info.productTypes(), ", "), device.Identifier)
+}
+
+// verifyZipMembers checks that every member of a zip decompresses and matches its CRC32.
+func verifyZipMembers(z *zip.Reader) error {
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		r, err := f.Open()
+
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.Name, err)
+		}
+
+		// archive/zip checks the size and CRC32 once the member has been read in full
+		_, err = io.Copy(ioutil.Discard, r)
+		r.Close()
+
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.Name, err)
+		}
+	}
+
+	return nil
+}
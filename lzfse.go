@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// LZFSE block magics, "bvx$", "bvx-", "bvx1", "bvx2" and "bvxn" read as little endian integers.
+const (
+	lzfseEndOfStreamMagic    = 0x24787662
+	lzfseUncompressedMagic   = 0x2d787662
+	lzfseCompressedV1Magic   = 0x31787662
+	lzfseCompressedV2Magic   = 0x32787662
+	lzfseCompressedLZVNMagic = 0x6e787662
+)
+
+const (
+	lzfseLiteralStates = 1024
+	lzfseLStates       = 64
+	lzfseMStates       = 64
+	lzfseDStates       = 256
+
+	lzfseLiteralSymbols = 256
+	lzfseLSymbols       = 20
+	lzfseMSymbols       = 20
+	lzfseDSymbols       = 64
+
+	lzfseMatchesPerBlock  = 10000
+	lzfseLiteralsPerBlock = 4 * lzfseMatchesPerBlock
+
+	// lzfseV1HeaderSize is the size of a version 1 compressed block header, including its frequency tables.
+	lzfseV1HeaderSize = 772
+
+	// lzfseV2HeaderSize is the size of a version 2 compressed block header before its frequency tables.
+	lzfseV2HeaderSize = 32
+)
+
+// extra bits and base values of the symbols for literal lengths (L), match lengths (M) and match distances (D).
+var (
+	lzfseLExtraBits = [lzfseLSymbols]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 3, 5, 8}
+	lzfseLBaseValue = [lzfseLSymbols]int32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 20, 28, 60}
+	lzfseMExtraBits = [lzfseMSymbols]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 5, 8, 11}
+	lzfseMBaseValue = [lzfseMSymbols]int32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 24, 56, 312}
+	lzfseDExtraBits = [lzfseDSymbols]uint8{
+		0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3,
+		4, 4, 4, 4, 5, 5, 5, 5, 6, 6, 6, 6, 7, 7, 7, 7,
+		8, 8, 8, 8, 9, 9, 9, 9, 10, 10, 10, 10, 11, 11, 11, 11,
+		12, 12, 12, 12, 13, 13, 13, 13, 14, 14, 14, 14, 15, 15, 15, 15,
+	}
+	lzfseDBaseValue = [lzfseDSymbols]int32{
+		0, 1, 2, 3, 4, 6, 8, 10, 12, 16, 20, 24, 28, 36, 44, 52,
+		60, 76, 92, 108, 124, 156, 188, 220, 252, 316, 380, 444, 508, 636, 764, 892,
+		1020, 1276, 1532, 1788, 2044, 2556, 3068, 3580, 4092, 5116, 6140, 7164, 8188, 10236, 12284, 14332,
+		16380, 20476, 24572, 28668, 32764, 40956, 49148, 57340, 65532, 81916, 98300, 114684, 131068, 163836, 196604, 229372,
+	}
+)
+
+var (
+	errLZFSETruncated = errors.New("truncated LZFSE data")
+	errLZFSEInvalid   = errors.New("invalid LZFSE data")
+)
+
+// isLZFSE reports whether data is LZFSE compressed.
+func isLZFSE(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("bvx2")) || bytes.HasPrefix(data, []byte("bvx1")) ||
+		bytes.HasPrefix(data, []byte("bvx-")) || bytes.HasPrefix(data, []byte("bvxn"))
+}
+
+// decompressLZFSE decompresses an LZFSE stream, as used by later kernelcaches. The stream is a series
+// of blocks, each of which may refer back to the output of the blocks before it, ending with "bvx$".
+// Anything after the end of the stream is ignored.
+func decompressLZFSE(data []byte) ([]byte, error) {
+	var dst []byte
+
+	pos := 0
+
+	for {
+		if len(data)-pos < 4 {
+			return nil, errLZFSETruncated
+		}
+
+		var err error
+
+		switch magic := binary.LittleEndian.Uint32(data[pos:]); magic {
+		case lzfseEndOfStreamMagic:
+			return dst, nil
+		case lzfseUncompressedMagic:
+			dst, pos, err = lzfseUncompressedBlock(dst, data, pos)
+		case lzfseCompressedLZVNMagic:
+			dst, pos, err = lzfseLZVNBlock(dst, data, pos)
+		case lzfseCompressedV1Magic, lzfseCompressedV2Magic:
+			dst, pos, err = lzfseCompressedBlock(dst, data, pos)
+		default:
+			return nil, fmt.Errorf("invalid LZFSE block magic: %#x", magic)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// lzfseUncompressedBlock appends the contents of the "bvx-" block at pos in src to dst, returning the
+// position of the next block.
+func lzfseUncompressedBlock(dst, src []byte, pos int) ([]byte, int, error) {
+	if len(src)-pos < 8 {
+		return nil, 0, errLZFSETruncated
+	}
+
+	n := binary.LittleEndian.Uint32(src[pos+4:])
+	pos += 8
+
+	if uint64(n) > uint64(len(src)-pos) {
+		return nil, 0, errLZFSETruncated
+	}
+
+	return append(dst, src[pos:pos+int(n)]...), pos + int(n), nil
+}
+
+// lzfseLZVNBlock decodes the "bvxn" block at pos in src, appending its output to dst and returning the
+// position of the next block.
+func lzfseLZVNBlock(dst, src []byte, pos int) ([]byte, int, error) {
+	if len(src)-pos < 12 {
+		return nil, 0, errLZFSETruncated
+	}
+
+	rawBytes := binary.LittleEndian.Uint32(src[pos+4:])
+	payloadBytes := binary.LittleEndian.Uint32(src[pos+8:])
+	pos += 12
+
+	if uint64(payloadBytes) > uint64(len(src)-pos) {
+		return nil, 0, errLZFSETruncated
+	}
+
+	dst, err := lzvn(dst, src[pos:pos+int(payloadBytes)], rawBytes)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return dst, pos + int(payloadBytes), nil
+}
+
+// lzfseBlockHeader is the header of a compressed ("bvx1" or "bvx2") block.
+type lzfseBlockHeader struct {
+	size     int // of the header, after which are the literal and LMD payloads
+	rawBytes uint32
+
+	literals            uint32
+	literalPayloadBytes uint32
+	literalBits         int32
+	literalState        [4]uint16
+
+	matches         uint32
+	lmdPayloadBytes uint32
+	lmdBits         int32
+	lState          uint16
+	mState          uint16
+	dState          uint16
+
+	// freq holds the frequency tables for L, M, D and literal symbols, in that order.
+	freq [lzfseLSymbols + lzfseMSymbols + lzfseDSymbols + lzfseLiteralSymbols]uint16
+}
+
+func (h *lzfseBlockHeader) lFreq() []uint16 {
+	return h.freq[:lzfseLSymbols]
+}
+
+func (h *lzfseBlockHeader) mFreq() []uint16 {
+	return h.freq[lzfseLSymbols : lzfseLSymbols+lzfseMSymbols]
+}
+
+func (h *lzfseBlockHeader) dFreq() []uint16 {
+	return h.freq[lzfseLSymbols+lzfseMSymbols : lzfseLSymbols+lzfseMSymbols+lzfseDSymbols]
+}
+
+func (h *lzfseBlockHeader) literalFreq() []uint16 {
+	return h.freq[lzfseLSymbols+lzfseMSymbols+lzfseDSymbols:]
+}
+
+// parseLZFSEV1Header parses a "bvx1" block header, which stores every field in full.
+func parseLZFSEV1Header(b []byte) (*lzfseBlockHeader, error) {
+	if len(b) < lzfseV1HeaderSize {
+		return nil, errLZFSETruncated
+	}
+
+	h := &lzfseBlockHeader{
+		size:                lzfseV1HeaderSize,
+		rawBytes:            binary.LittleEndian.Uint32(b[4:]),
+		literals:            binary.LittleEndian.Uint32(b[12:]),
+		matches:             binary.LittleEndian.Uint32(b[16:]),
+		literalPayloadBytes: binary.LittleEndian.Uint32(b[20:]),
+		lmdPayloadBytes:     binary.LittleEndian.Uint32(b[24:]),
+		literalBits:         int32(binary.LittleEndian.Uint32(b[28:])),
+		lmdBits:             int32(binary.LittleEndian.Uint32(b[40:])),
+		lState:              binary.LittleEndian.Uint16(b[44:]),
+		mState:              binary.LittleEndian.Uint16(b[46:]),
+		dState:              binary.LittleEndian.Uint16(b[48:]),
+	}
+
+	for i := range h.literalState {
+		h.literalState[i] = binary.LittleEndian.Uint16(b[32+2*i:])
+	}
+
+	for i := range h.freq {
+		h.freq[i] = binary.LittleEndian.Uint16(b[50+2*i:])
+	}
+
+	return h, nil
+}
+
+// parseLZFSEV2Header parses a "bvx2" block header, whose fields are packed into three 64 bit
+// integers and whose frequency tables are stored with a variable length encoding.
+func parseLZFSEV2Header(b []byte) (*lzfseBlockHeader, error) {
+	if len(b) < lzfseV2HeaderSize {
+		return nil, errLZFSETruncated
+	}
+
+	v0 := binary.LittleEndian.Uint64(b[8:])
+	v1 := binary.LittleEndian.Uint64(b[16:])
+	v2 := binary.LittleEndian.Uint64(b[24:])
+
+	field := func(v uint64, offset, n uint) uint32 {
+		return uint32(v>>offset) & (1<<n - 1)
+	}
+
+	h := &lzfseBlockHeader{
+		size:     int(field(v2, 0, 32)),
+		rawBytes: binary.LittleEndian.Uint32(b[4:]),
+
+		literals:            field(v0, 0, 20),
+		literalPayloadBytes: field(v0, 20, 20),
+		literalBits:         int32(field(v0, 60, 3)) - 7,
+
+		matches:         field(v0, 40, 20),
+		lmdPayloadBytes: field(v1, 40, 20),
+		lmdBits:         int32(field(v1, 60, 3)) - 7,
+		lState:          uint16(field(v2, 32, 10)),
+		mState:          uint16(field(v2, 42, 10)),
+		dState:          uint16(field(v2, 52, 10)),
+	}
+
+	for i := range h.literalState {
+		h.literalState[i] = uint16(field(v1, uint(10*i), 10))
+	}
+
+	if h.size < lzfseV2HeaderSize || h.size > len(b) {
+		return nil, errLZFSETruncated
+	}
+
+	// the frequency tables may be left out, leaving them all zero
+	if h.size == lzfseV2HeaderSize {
+		return h, nil
+	}
+
+	src := b[lzfseV2HeaderSize:h.size]
+
+	var accum uint32
+	var accumBits uint
+
+	for i := range h.freq {
+		for len(src) > 0 && accumBits+8 <= 32 {
+			accum |= uint32(src[0]) << accumBits
+			accumBits += 8
+			src = src[1:]
+		}
+
+		value, n := lzfseFreqValue(accum)
+
+		if n > accumBits {
+			return nil, errLZFSEInvalid
+		}
+
+		h.freq[i] = value
+		accum >>= n
+		accumBits -= n
+	}
+
+	// the tables must end exactly at the end of the header
+	if accumBits >= 8 || len(src) > 0 {
+		return nil, errLZFSEInvalid
+	}
+
+	return h, nil
+}
+
+// lzfseFreqValue decodes a frequency from the low bits of accum, returning it and the number of bits it
+// used. 0-7 use 2 to 5 bits, 8-23 use 8 bits and 24-1047 use 14 bits.
+func lzfseFreqValue(accum uint32) (uint16, uint) {
+	nbits := [32]uint{
+		2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+		2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+	}
+
+	values := [32]uint16{
+		0, 2, 1, 4, 0, 3, 1, 0, 0, 2, 1, 5, 0, 3, 1, 0,
+		0, 2, 1, 6, 0, 3, 1, 0, 0, 2, 1, 7, 0, 3, 1, 0,
+	}
+
+	b := accum & 31
+
+	switch n := nbits[b]; n {
+	case 8:
+		return 8 + uint16(accum>>4&0xf), n
+	case 14:
+		return 24 + uint16(accum>>4&0x3ff), n
+	default:
+		return values[b], n
+	}
+}
+
+// lzfseCompressedBlock decodes the "bvx1" or "bvx2" block at pos in src, appending its output to dst
+// and returning the position of the next block. The block holds a header, literals encoded in four
+// interleaved FSE streams, and a stream of literal length, match length and match distance (LMD)
+// triples, each stream being read backwards from its end.
+func lzfseCompressedBlock(dst, src []byte, pos int) ([]byte, int, error) {
+	var h *lzfseBlockHeader
+	var err error
+
+	if binary.LittleEndian.Uint32(src[pos:]) == lzfseCompressedV1Magic {
+		h, err = parseLZFSEV1Header(src[pos:])
+	} else {
+		h, err = parseLZFSEV2Header(src[pos:])
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if h.literals > lzfseLiteralsPerBlock || h.matches > lzfseMatchesPerBlock {
+		return nil, 0, errLZFSEInvalid
+	}
+
+	for _, state := range h.literalState {
+		if state >= lzfseLiteralStates {
+			return nil, 0, errLZFSEInvalid
+		}
+	}
+
+	if h.lState >= lzfseLStates || h.mState >= lzfseMStates || h.dState >= lzfseDStates {
+		return nil, 0, errLZFSEInvalid
+	}
+
+	literalEnd := uint64(pos) + uint64(h.size) + uint64(h.literalPayloadBytes)
+	lmdEnd := literalEnd + uint64(h.lmdPayloadBytes)
+
+	if lmdEnd > uint64(len(src)) {
+		return nil, 0, errLZFSETruncated
+	}
+
+	literalTable, err := fseTable(lzfseLiteralStates, h.literalFreq())
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lTable, err := fseTable(lzfseLStates, h.lFreq())
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	mTable, err := fseTable(lzfseMStates, h.mFreq())
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dTable, err := fseTable(lzfseDStates, h.dFreq())
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// literals are decoded four at a time, one from each stream
+	literals := make([]byte, (h.literals+3)&^3)
+
+	in, err := newFSEInStream(src, int(literalEnd), h.literalBits)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	states := h.literalState
+
+	for i := 0; i < len(literals); i += 4 {
+		if err := in.flush(); err != nil {
+			return nil, 0, err
+		}
+
+		for j := range states {
+			literals[i+j] = in.decode(&states[j], literalTable)
+		}
+	}
+
+	in, err = newFSEInStream(src, int(lmdEnd), h.lmdBits)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	end := uint64(len(dst)) + uint64(h.rawBytes)
+	lState, mState, dState := h.lState, h.mState, h.dState
+	distance := -1
+	literal := 0
+
+	for i := uint32(0); i < h.matches; i++ {
+		if err := in.flush(); err != nil {
+			return nil, 0, err
+		}
+
+		l := in.decodeValue(&lState, lTable, lzfseLExtraBits[:], lzfseLBaseValue[:])
+		m := in.decodeValue(&mState, mTable, lzfseMExtraBits[:], lzfseMBaseValue[:])
+
+		// a distance of 0 repeats the previous one
+		if d := in.decodeValue(&dState, dTable, lzfseDExtraBits[:], lzfseDBaseValue[:]); d != 0 {
+			distance = d
+		}
+
+		if literal+l > len(literals) || uint64(len(dst)+l+m) > end {
+			return nil, 0, errLZFSEInvalid
+		}
+
+		if distance < 0 || distance > len(dst)+l {
+			return nil, 0, fmt.Errorf("invalid LZFSE match distance: %d", distance)
+		}
+
+		dst = append(dst, literals[literal:literal+l]...)
+		literal += l
+
+		dst = appendMatch(dst, distance, m)
+	}
+
+	if uint64(len(dst)) != end {
+		return nil, 0, errors.New("LZFSE block did not decompress to the expected size")
+	}
+
+	return dst, int(lmdEnd), nil
+}
+
+// fseEntry is the entry of an FSE decoding table for one state: the symbol it decodes to, and the
+// next state, which is delta plus the next k bits of the stream.
+type fseEntry struct {
+	k      uint8
+	symbol uint8
+	delta  int32
+}
+
+// fseTable builds the decoding table for an FSE stream with nstates states, in which each symbol
+// occupies as many states as its frequency.
+func fseTable(nstates int, freq []uint16) ([]fseEntry, error) {
+	table := make([]fseEntry, nstates)
+	clz := bits.LeadingZeros32(uint32(nstates))
+
+	state := 0
+
+	for symbol, f := range freq {
+		if f == 0 {
+			continue
+		}
+
+		if state+int(f) > nstates {
+			return nil, errLZFSEInvalid
+		}
+
+		// the smallest shift for which nstates <= f<<k < 2*nstates
+		k := bits.LeadingZeros32(uint32(f)) - clz
+		j0 := (2*nstates)>>uint(k) - int(f)
+
+		for j := 0; j < int(f); j++ {
+			e := fseEntry{symbol: uint8(symbol)}
+
+			if j < j0 {
+				e.k = uint8(k)
+				e.delta = int32((int(f)+j)<<uint(k) - nstates)
+			} else {
+				e.k = uint8(k - 1)
+				e.delta = int32((j - j0) << uint(k-1))
+			}
+
+			table[state] = e
+			state++
+		}
+	}
+
+	return table, nil
+}
+
+// fseInStream reads an FSE bit stream backwards from its end, most significant bits first.
+type fseInStream struct {
+	src   []byte
+	pos   int // of the last byte loaded into accum
+	accum uint64
+	nbits uint
+}
+
+// newFSEInStream starts reading the stream which ends at end in src. n (-7 to 0) is minus the number of
+// unused bits at the top of its last byte.
+func newFSEInStream(src []byte, end int, n int32) (*fseInStream, error) {
+	in := &fseInStream{src: src}
+
+	load := 7
+
+	if n != 0 {
+		load = 8
+	}
+
+	if end < load {
+		return nil, errLZFSETruncated
+	}
+
+	in.pos = end - load
+
+	for i := end - 1; i >= in.pos; i-- {
+		in.accum = in.accum<<8 | uint64(src[i])
+	}
+
+	nbits := int(n) + 8*load
+
+	// the unused bits must be zero
+	if nbits < 56 || nbits >= 64 || in.accum>>uint(nbits) != 0 {
+		return nil, errLZFSEInvalid
+	}
+
+	in.nbits = uint(nbits)
+
+	return in, nil
+}
+
+// flush loads whole bytes into the accumulator, leaving at least 56 bits to read.
+func (in *fseInStream) flush() error {
+	n := (63 - in.nbits) &^ 7
+
+	if in.pos < int(n/8) {
+		return errLZFSETruncated
+	}
+
+	in.pos -= int(n / 8)
+
+	var incoming uint64
+
+	for i := in.pos + int(n/8) - 1; i >= in.pos; i-- {
+		incoming = incoming<<8 | uint64(in.src[i])
+	}
+
+	in.accum = in.accum<<n | incoming
+	in.nbits += n
+
+	return nil
+}
+
+// pull reads the next n bits.
+func (in *fseInStream) pull(n uint8) uint64 {
+	in.nbits -= uint(n)
+	v := in.accum >> in.nbits
+	in.accum &= 1<<in.nbits - 1
+
+	return v
+}
+
+// decode returns the symbol for state and moves it on to the next state.
+func (in *fseInStream) decode(state *uint16, table []fseEntry) uint8 {
+	e := table[*state]
+	*state = uint16(e.delta + int32(in.pull(e.k)))
+
+	return e.symbol
+}
+
+// decodeValue decodes a symbol, then adds the symbol's extra bits to its base value.
+func (in *fseInStream) decodeValue(state *uint16, table []fseEntry, extraBits []uint8, baseValue []int32) int {
+	symbol := in.decode(state, table)
+
+	return int(baseValue[symbol]) + int(in.pull(extraBits[symbol]))
+}
+
+// lzvn appends the output of the LZVN compressed src, which must be size bytes, to dst. Matches may
+// refer back to anything already in dst.
+func lzvn(dst, src []byte, size uint32) ([]byte, error) {
+	end := uint64(len(dst)) + uint64(size)
+
+	// the previous match distance, which some opcodes reuse
+	distance := 0
+
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, errLZFSETruncated
+		}
+
+		opcode := src[i]
+
+		// lengths of the opcode, the literal following it, and the match
+		var n, l, m int
+
+		switch {
+		case opcode == 0x06:
+			// end of stream, followed by 7 bytes of padding
+			if len(src)-i < 8 {
+				return nil, errLZFSETruncated
+			}
+
+			if uint64(len(dst)) != end {
+				return nil, errors.New("LZVN data did not decompress to the expected size")
+			}
+
+			return dst, nil
+		case opcode == 0x0e || opcode == 0x16:
+			// no-op
+			n = 1
+		case opcode < 0x40 && opcode&7 == 6, opcode >= 0x70 && opcode < 0x80, opcode >= 0xd0 && opcode < 0xe0:
+			return nil, fmt.Errorf("invalid LZVN opcode: %#x", opcode)
+		case opcode == 0xe0:
+			// large literal: 11100000 LLLLLLLL
+			if len(src)-i <= 2 {
+				return nil, errLZFSETruncated
+			}
+
+			n, l = 2, int(src[i+1])+16
+		case opcode > 0xe0 && opcode < 0xf0:
+			// small literal: 1110LLLL
+			n, l = 1, int(opcode&0xf)
+		case opcode == 0xf0:
+			// large match with the previous distance: 11110000 MMMMMMMM
+			if len(src)-i <= 2 {
+				return nil, errLZFSETruncated
+			}
+
+			n, m = 2, int(src[i+1])+16
+		case opcode > 0xf0:
+			// small match with the previous distance: 1111MMMM
+			n, m = 1, int(opcode&0xf)
+		case opcode >= 0xa0 && opcode < 0xc0:
+			// medium distance: 101LLMMM DDDDDDMM DDDDDDDD
+			n, l = 3, int(opcode>>3&3)
+
+			if len(src)-i <= n+l {
+				return nil, errLZFSETruncated
+			}
+
+			operand := int(binary.LittleEndian.Uint16(src[i+1:]))
+			m = (int(opcode&7)<<2 | operand&3) + 3
+			distance = operand >> 2
+		case opcode&7 == 7:
+			// large distance: LLMMM111 DDDDDDDD DDDDDDDD
+			n, l, m = 3, int(opcode>>6), int(opcode>>3&7)+3
+
+			if len(src)-i <= n+l {
+				return nil, errLZFSETruncated
+			}
+
+			distance = int(binary.LittleEndian.Uint16(src[i+1:]))
+		case opcode&7 == 6:
+			// previous distance: LLMMM110
+			n, l, m = 1, int(opcode>>6), int(opcode>>3&7)+3
+		default:
+			// small distance: LLMMMDDD DDDDDDDD
+			n, l, m = 2, int(opcode>>6), int(opcode>>3&7)+3
+
+			if len(src)-i <= n+l {
+				return nil, errLZFSETruncated
+			}
+
+			distance = int(opcode&7)<<8 | int(src[i+1])
+		}
+
+		// the stream must always have room for at least the end of stream opcode
+		if len(src)-i <= n+l {
+			return nil, errLZFSETruncated
+		}
+
+		if uint64(len(dst)+l+m) > end {
+			return nil, errors.New("LZVN data decompresses to more than the expected size")
+		}
+
+		i += n
+
+		dst = append(dst, src[i:i+l]...)
+		i += l
+
+		if m == 0 {
+			continue
+		}
+
+		if distance == 0 || distance > len(dst) {
+			return nil, fmt.Errorf("invalid LZVN match distance: %d", distance)
+		}
+
+		dst = appendMatch(dst, distance, m)
+	}
+}
+
+// appendMatch appends n bytes copied from distance bytes back in dst, which may overlap the bytes
+// being appended.
+func appendMatch(dst []byte, distance, n int) []byte {
+	start := len(dst) - distance
+
+	if distance >= n {
+		return append(dst, dst[start:start+n]...)
+	}
+
+	for k := 0; k < n; k++ {
+		dst = append(dst, dst[start+k])
+	}
+
+	return dst
+}
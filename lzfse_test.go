@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// lzvnTestStream uses every LZVN opcode, decompressing to lzvnTestOutput.
+var lzvnTestStream = []byte{
+	0xe3, 'a', 'b', 'c', // small literal "abc"
+	0x50, 0x04, 'd', // small distance: literal "d", match 5 at distance 4 ("abcda")
+	0x46, 'e', // previous distance: literal "e", match 3 at distance 4 ("cda")
+	0xf2,             // small match: 2 at distance 4 ("ec")
+	0x0e,             // no-op
+	0xa0, 0x15, 0x00, // medium distance: match 4 at distance 5 ("cdae")
+	0x87, 0x15, 0x00, 'x', 'y', // large distance: literal "xy", match 3 at distance 21 ("abc")
+	0xe0, 0x00, '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f', // large literal
+	0xf0, 0x01, // large match: 17 at distance 21 ("xyabc0123456789ab")
+	0x06, 0, 0, 0, 0, 0, 0, 0, // end of stream
+}
+
+const lzvnTestOutput = "abcdabcdaecdaeccdae" + "xyabc" + "0123456789abcdef" + "xyabc0123456789ab"
+
+func TestLZVN(t *testing.T) {
+	tests := []struct {
+		name     string
+		dst      string
+		src      []byte
+		size     uint32
+		expected string
+		err      bool
+	}{
+		{"every opcode", "", lzvnTestStream, uint32(len(lzvnTestOutput)), lzvnTestOutput, false},
+		{"match into earlier output", "abc", []byte{0xf3, 0x06, 0, 0, 0, 0, 0, 0, 0}, 3, "", true},
+		{"distance into earlier output", "abc", []byte{0x18, 0x03, 0x06, 0, 0, 0, 0, 0, 0, 0}, 6, "abcabc", false},
+		{"distance too far", "", []byte{0x48, 0x02, 'a', 0x06, 0, 0, 0, 0, 0, 0, 0}, 7, "", true},
+		{"undefined opcode", "", []byte{0x1e, 0x06, 0, 0, 0, 0, 0, 0, 0}, 0, "", true},
+		{"no end of stream", "", []byte{0xe1, 'a'}, 1, "", true},
+		{"short end of stream", "", []byte{0xe1, 'a', 0x06, 0, 0}, 1, "", true},
+		{"wrong size", "", []byte{0xe1, 'a', 0x06, 0, 0, 0, 0, 0, 0, 0}, 2, "", true},
+		{"too large", "", []byte{0xe2, 'a', 'b', 0x06, 0, 0, 0, 0, 0, 0, 0}, 1, "", true},
+	}
+
+	for _, test := range tests {
+		out, err := lzvn([]byte(test.dst), test.src, test.size)
+
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if err == nil && string(out) != test.dst+test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.dst+test.expected)
+		}
+	}
+}
+
+// fseStreamBytes builds an FSE stream which returns each of values (n bits each) in turn, read
+// backwards from the end with padding unused bits at the top of its last byte.
+func fseStreamBytes(values [][2]uint64, padding int) []byte {
+	var bits []uint64
+
+	for _, v := range values {
+		for i := int(v[1]) - 1; i >= 0; i-- {
+			bits = append(bits, v[0]>>uint(i)&1)
+		}
+	}
+
+	n := (len(bits) + padding + 7) / 8
+
+	if n < 8 {
+		n = 8
+	}
+
+	b := make([]byte, n)
+
+	for i, bit := range bits {
+		position := 8*n - padding - 1 - i
+		b[position/8] |= byte(bit << uint(position%8))
+	}
+
+	return b
+}
+
+// lzfseFreqBits encodes a frequency for a version 2 block header.
+func lzfseFreqBits(f uint16) (uint32, uint) {
+	switch {
+	case f < 8:
+		codes := []uint32{0x0, 0x2, 0x1, 0x5, 0x3, 0xb, 0x13, 0x1b}
+		lengths := []uint{2, 2, 3, 3, 5, 5, 5, 5}
+
+		return codes[f], lengths[f]
+	case f < 24:
+		return 0x7 | uint32(f-8)<<4, 8
+	default:
+		return 0xf | uint32(f-24)<<4, 14
+	}
+}
+
+// lzfseTestBlock is a version 2 compressed block, before it is encoded.
+type lzfseTestBlock struct {
+	rawBytes     uint32
+	literals     uint32
+	matches      uint32
+	literalState [4]uint16
+	lState       uint16
+	mState       uint16
+	dState       uint16
+
+	lFreq, mFreq, dFreq, literalFreq map[int]uint16
+
+	literalValues, lmdValues   [][2]uint64
+	literalPadding, lmdPadding int
+}
+
+func (b *lzfseTestBlock) bytes() []byte {
+	var freq []uint16
+
+	for _, table := range []struct {
+		freq    map[int]uint16
+		symbols int
+	}{{b.lFreq, lzfseLSymbols}, {b.mFreq, lzfseMSymbols}, {b.dFreq, lzfseDSymbols}, {b.literalFreq, lzfseLiteralSymbols}} {
+		for i := 0; i < table.symbols; i++ {
+			freq = append(freq, table.freq[i])
+		}
+	}
+
+	var tables []byte
+	var accum uint64
+	var accumBits uint
+
+	for _, f := range freq {
+		code, n := lzfseFreqBits(f)
+		accum |= uint64(code) << accumBits
+		accumBits += n
+
+		for accumBits >= 8 {
+			tables = append(tables, byte(accum))
+			accum >>= 8
+			accumBits -= 8
+		}
+	}
+
+	if accumBits > 0 {
+		tables = append(tables, byte(accum))
+	}
+
+	literalPayload := fseStreamBytes(b.literalValues, b.literalPadding)
+	lmdPayload := fseStreamBytes(b.lmdValues, b.lmdPadding)
+
+	v0 := uint64(b.literals) | uint64(len(literalPayload))<<20 | uint64(b.matches)<<40 | uint64(7-b.literalPadding)<<60
+	v1 := uint64(len(lmdPayload))<<40 | uint64(7-b.lmdPadding)<<60
+	v2 := uint64(lzfseV2HeaderSize+len(tables)) | uint64(b.lState)<<32 | uint64(b.mState)<<42 | uint64(b.dState)<<52
+
+	for i, state := range b.literalState {
+		v1 |= uint64(state) << uint(10*i)
+	}
+
+	header := make([]byte, lzfseV2HeaderSize)
+	copy(header, "bvx2")
+	binary.LittleEndian.PutUint32(header[4:], b.rawBytes)
+	binary.LittleEndian.PutUint64(header[8:], v0)
+	binary.LittleEndian.PutUint64(header[16:], v1)
+	binary.LittleEndian.PutUint64(header[24:], v2)
+
+	return bytes.Join([][]byte{header, tables, literalPayload, lmdPayload}, nil)
+}
+
+// newLZFSETestBlock returns a block of two matches. Its literals use two symbols, 'a' in states 0-511
+// and 'b' in states 512-1023, each state s moving on to 2*(s%512) plus one bit, which decode to
+// "abab" then "abba". L is always 4, M is 16 plus 3 bits, and D uses states 0-127 for a repeated
+// distance and 128-255 for 4 plus 1 bit, each state s moving on to 2*(s%128) plus one bit.
+func newLZFSETestBlock() *lzfseTestBlock {
+	return &lzfseTestBlock{
+		rawBytes:     47,
+		literals:     8,
+		matches:      2,
+		literalState: [4]uint16{0, 768, 256, 512},
+		dState:       133,
+
+		lFreq:       map[int]uint16{4: 64},
+		mFreq:       map[int]uint16{16: 64},
+		dFreq:       map[int]uint16{0: 128, 4: 128},
+		literalFreq: map[int]uint16{'a': 512, 'b': 512},
+
+		literalValues: [][2]uint64{{1, 1}, {0, 1}, {1, 1}, {0, 1}, {1, 1}, {1, 1}, {0, 1}, {0, 1}},
+		lmdValues: [][2]uint64{
+			{2, 3}, {0, 1}, {0, 1}, // M = 18, D moves to state 10, D = 4
+			{5, 3}, {1, 1}, // M = 21, D moves to state 21, D repeats
+		},
+		literalPadding: 3,
+	}
+}
+
+// lzfseTestOutput is what newLZFSETestBlock decodes to: "abab" followed by 18 bytes at distance 4, then
+// "abba" followed by 21 bytes at distance 4.
+var lzfseTestOutput = strings.Repeat("ab", 11) + strings.Repeat("abba", 6) + "a"
+
+func lzfseBlock(magic string, fields []uint32, payload string) []byte {
+	b := []byte(magic)
+
+	for _, field := range fields {
+		b = append(b, le32(field)...)
+	}
+
+	return append(b, payload...)
+}
+
+func TestDecompressLZFSE(t *testing.T) {
+	compressed := newLZFSETestBlock().bytes()
+
+	noFreq := newLZFSETestBlock()
+	noFreq.lFreq, noFreq.mFreq, noFreq.dFreq, noFreq.literalFreq = nil, nil, nil, nil
+
+	// the same block with a version 1 header
+	header, err := parseLZFSEV2Header(compressed)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := make([]byte, lzfseV1HeaderSize)
+	copy(v1, "bvx1")
+
+	for offset, v := range map[int]uint32{
+		4:  header.rawBytes,
+		8:  header.literalPayloadBytes + header.lmdPayloadBytes,
+		12: header.literals,
+		16: header.matches,
+		20: header.literalPayloadBytes,
+		24: header.lmdPayloadBytes,
+		28: uint32(header.literalBits),
+		40: uint32(header.lmdBits),
+	} {
+		binary.LittleEndian.PutUint32(v1[offset:], v)
+	}
+
+	for i, state := range header.literalState {
+		binary.LittleEndian.PutUint16(v1[32+2*i:], state)
+	}
+
+	for i, state := range []uint16{header.lState, header.mState, header.dState} {
+		binary.LittleEndian.PutUint16(v1[44+2*i:], state)
+	}
+
+	for i, f := range header.freq {
+		binary.LittleEndian.PutUint16(v1[50+2*i:], f)
+	}
+
+	v1 = append(v1, compressed[header.size:]...)
+
+	tooFar := newLZFSETestBlock()
+	tooFar.lmdValues = [][2]uint64{{2, 3}, {1, 1}, {1, 1}, {5, 3}, {1, 1}}
+	tooFar.dState = 255
+
+	wrongSize := newLZFSETestBlock()
+	wrongSize.rawBytes = 46
+
+	overfull := newLZFSETestBlock()
+	overfull.literalFreq = map[int]uint16{'a': 512, 'b': 513}
+
+	end := []byte("bvx$")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+		err      bool
+	}{
+		{"empty stream", end, "", false},
+		{"uncompressed", bytes.Join([][]byte{lzfseBlock("bvx-", []uint32{5}, "hello"), end}, nil), "hello", false},
+		{"lzvn", bytes.Join([][]byte{lzfseBlock("bvxn", []uint32{uint32(len(lzvnTestOutput)), uint32(len(lzvnTestStream))}, string(lzvnTestStream)), end}, nil), lzvnTestOutput, false},
+		{"compressed", append(compressed, end...), lzfseTestOutput, false},
+		{
+			"blocks referring back",
+			bytes.Join([][]byte{
+				lzfseBlock("bvx-", []uint32{3}, "abc"),
+				lzfseBlock("bvxn", []uint32{6, 10}, "\x18\x03\x06\x00\x00\x00\x00\x00\x00\x00"),
+				compressed,
+				end,
+				[]byte("trailing data"),
+			}, nil),
+			"abcabcabc" + lzfseTestOutput,
+			false,
+		},
+		{"version 1", append(v1, end...), lzfseTestOutput, false},
+		{"empty frequency tables", append(noFreq.bytes(), end...), "", true},
+		{"distance too far", append(tooFar.bytes(), end...), "", true},
+		{"wrong size", append(wrongSize.bytes(), end...), "", true},
+		{"too many states", append(overfull.bytes(), end...), "", true},
+		{"truncated compressed block", compressed[:len(compressed)-1], "", true},
+		{"no end of stream", lzfseBlock("bvx-", []uint32{5}, "hello"), "", true},
+		{"truncated uncompressed block", lzfseBlock("bvx-", []uint32{6}, "hello"), "", true},
+		{"invalid magic", []byte("bvx3"), "", true},
+	}
+
+	for _, test := range tests {
+		out, err := decompressLZFSE(test.data)
+
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if string(out) != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.expected)
+		}
+	}
+}
+
+func TestDecodeImageLZFSE(t *testing.T) {
+	data := append(newLZFSETestBlock().bytes(), "bvx$"...)
+
+	out, err := decodeImage(im4pBytes(t, "krnl", data, nil), "kernelcache.release.n71", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != lzfseTestOutput {
+		t.Errorf("got %q, expected %q", out, lzfseTestOutput)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// lzssHeaderSize is the size of the "complzss" header preceding LZSS compressed kernelcaches.
+const lzssHeaderSize = 0x180
+
+// decompressLZSS decompresses data with a "complzss" header, as used by kernelcaches.
+func decompressLZSS(data []byte) ([]byte, error) {
+	if len(data) < lzssHeaderSize || !bytes.HasPrefix(data, []byte("complzss")) {
+		return nil, errors.New("not LZSS compressed")
+	}
+
+	uncompressedSize := binary.BigEndian.Uint32(data[12:])
+	compressedSize := binary.BigEndian.Uint32(data[16:])
+
+	if uint64(compressedSize) > uint64(len(data)-lzssHeaderSize) {
+		return nil, errors.New("truncated LZSS data")
+	}
+
+	out := lzss(data[lzssHeaderSize:lzssHeaderSize+int(compressedSize)], int(uncompressedSize))
+
+	if len(out) != int(uncompressedSize) {
+		return nil, errors.New("LZSS data did not decompress to the expected size")
+	}
+
+	return out, nil
+}
+
+// lzss decompresses Apple's LZSS variant: a 4096 byte ring buffer initialised with spaces,
+// 18 byte maximum matches and flag bytes read least significant bit first.
+func lzss(src []byte, size int) []byte {
+	const (
+		n         = 4096
+		f         = 18
+		threshold = 2
+	)
+
+	var ring [n + f - 1]byte
+
+	for i := 0; i < n-f; i++ {
+		ring[i] = ' '
+	}
+
+	r := n - f
+
+	// each compressed byte expands to at most 9 bytes, so don't trust the header any further than that
+	capacity := size
+
+	if capacity > len(src)*9 {
+		capacity = len(src) * 9
+	}
+
+	dst := make([]byte, 0, capacity)
+
+	var flags uint
+
+	i := 0
+
+	for len(dst) < size {
+		flags >>= 1
+
+		if flags&0x100 == 0 {
+			if i >= len(src) {
+				break
+			}
+
+			flags = uint(src[i]) | 0xff00
+			i++
+		}
+
+		if flags&1 != 0 {
+			if i >= len(src) {
+				break
+			}
+
+			c := src[i]
+			i++
+
+			dst = append(dst, c)
+			ring[r] = c
+			r = (r + 1) & (n - 1)
+
+			continue
+		}
+
+		if i+1 >= len(src) {
+			break
+		}
+
+		position := int(src[i]) | int(src[i+1]&0xf0)<<4
+		length := int(src[i+1]&0x0f) + threshold
+		i += 2
+
+		for k := 0; k <= length && len(dst) < size; k++ {
+			c := ring[(position+k)&(n-1)]
+
+			dst = append(dst, c)
+			ring[r] = c
+			r = (r + 1) & (n - 1)
+		}
+	}
+
+	return dst
+}
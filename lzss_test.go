@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestLZSS(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      []byte
+		size     int
+		expected string
+	}{
+		{
+			name:     "literals",
+			src:      []byte{0xff, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h'},
+			size:     8,
+			expected: "abcdefgh",
+		},
+		{
+			// two literals, then 6 bytes from the start of the literals (0xfee), overlapping the output
+			name:     "overlapping match",
+			src:      []byte{0x03, 'a', 'b', 0xee, 0xf3},
+			size:     8,
+			expected: "abababab",
+		},
+		{
+			// the ring buffer starts out filled with spaces
+			name:     "initial spaces",
+			src:      []byte{0x02, 0x00, 0x00, 'x'},
+			size:     4,
+			expected: "   x",
+		},
+		{
+			name:     "truncated",
+			src:      []byte{0xff, 'a', 'b'},
+			size:     8,
+			expected: "ab",
+		},
+	}
+
+	for _, test := range tests {
+		if out := string(lzss(test.src, test.size)); out != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.expected)
+		}
+	}
+}
+
+func TestDecompressLZSS(t *testing.T) {
+	compressed := []byte{0x03, 'a', 'b', 0xee, 0xf3}
+
+	header := func(uncompressedSize, compressedSize uint32) []byte {
+		b := make([]byte, lzssHeaderSize)
+		copy(b, "complzss")
+		binary.BigEndian.PutUint32(b[12:], uncompressedSize)
+		binary.BigEndian.PutUint32(b[16:], compressedSize)
+
+		return b
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+		err      bool
+	}{
+		{"valid", append(header(8, 5), compressed...), "abababab", false},
+		{"not lzss", make([]byte, lzssHeaderSize+5), "", true},
+		{"truncated", append(header(8, 50), compressed...), "", true},
+		{"wrong size", append(header(9, 5), compressed...), "", true},
+	}
+
+	for _, test := range tests {
+		out, err := decompressLZSS(test.data)
+
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if string(out) != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.expected)
+		}
+	}
+}
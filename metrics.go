@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counters exposed on /metrics. They are updated atomically as downloads may run concurrently.
+var (
+	filesDownloaded, filesFailed, filesVerified, filesCorrupt, filesMismatched, filesSkipped uint64
+
+	downloadQueueDepth  int64
+	lastSuccessfulSync  int64
+	downloadThroughput  uint64
+	throughputSampler   sync.Once
+	apiRequestMetricsMu sync.Mutex
+	apiRequestMetrics   = make(map[string]*apiRequestMetric)
+)
+
+type apiRequestMetric struct {
+	count, errors uint64
+	seconds       float64
+}
+
+// observeAPIRequest records the duration and outcome of a request to an API endpoint.
+func observeAPIRequest(endpoint string, duration time.Duration, failed bool) {
+	apiRequestMetricsMu.Lock()
+	defer apiRequestMetricsMu.Unlock()
+
+	metric, ok := apiRequestMetrics[endpoint]
+
+	if !ok {
+		metric = &apiRequestMetric{}
+		apiRequestMetrics[endpoint] = metric
+	}
+
+	metric.count++
+	metric.seconds += duration.Seconds()
+
+	if failed {
+		metric.errors++
+	}
+}
+
+// markSynced records that the API data was successfully retrieved.
+func markSynced() {
+	atomic.StoreInt64(&lastSuccessfulSync, time.Now().Unix())
+}
+
+// sampleThroughput updates the download throughput gauge every few seconds.
+func sampleThroughput() {
+	const interval = 5 * time.Second
+
+	last := atomic.LoadUint64(&downloadedSize)
+
+	for range time.Tick(interval) {
+		current := atomic.LoadUint64(&downloadedSize)
+
+		atomic.StoreUint64(&downloadThroughput, uint64(float64(current-last)/interval.Seconds()))
+
+		last = current
+	}
+}
+
+// metricsHandler serves metrics in the Prometheus text format. index is used to report the size
+// of the library, and may be nil.
+func metricsHandler(index func() *archiveIndex) http.Handler {
+	throughputSampler.Do(func() {
+		go sampleThroughput()
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		m := &metricsWriter{w: w}
+
+		m.metric("atf_downloaded_bytes_total", "counter", "Total bytes downloaded.", float64(atomic.LoadUint64(&downloadedSize)))
+		m.metric("atf_files_downloaded_total", "counter", "Firmwares downloaded successfully.", float64(atomic.LoadUint64(&filesDownloaded)))
+		m.metric("atf_files_failed_total", "counter", "Firmwares which failed to download.", float64(atomic.LoadUint64(&filesFailed)))
+		m.metric("atf_files_skipped_total", "counter", "Firmwares which were skipped, e.g. as they already exist or do not fit.", float64(atomic.LoadUint64(&filesSkipped)))
+		m.metric("atf_files_verified_total", "counter", "Firmwares which passed verification.", float64(atomic.LoadUint64(&filesVerified)))
+		m.metric("atf_files_corrupt_total", "counter", "Firmwares which failed verification.", float64(atomic.LoadUint64(&filesCorrupt)))
+		m.metric("atf_files_mismatched_total", "counter", "Firmwares which are intact but do not match the API's checksum (with -deep).", float64(atomic.LoadUint64(&filesMismatched)))
+		m.metric("atf_download_throughput_bytes", "gauge", "Current download rate in bytes per second.", float64(atomic.LoadUint64(&downloadThroughput)))
+		m.metric("atf_download_queue_depth", "gauge", "Firmwares waiting to be downloaded.", float64(atomic.LoadInt64(&downloadQueueDepth)))
+
+		if synced := atomic.LoadInt64(&lastSuccessfulSync); synced > 0 {
+			m.metric("atf_last_successful_sync_timestamp_seconds", "gauge", "When API data was last retrieved successfully.", float64(synced))
+		}
+
+		apiRequestMetricsMu.Lock()
+
+		endpoints := make([]string, 0, len(apiRequestMetrics))
+
+		for endpoint := range apiRequestMetrics {
+			endpoints = append(endpoints, endpoint)
+		}
+
+		sort.Strings(endpoints)
+
+		m.header("atf_api_request_duration_seconds", "summary", "Duration of API requests.")
+
+		for _, endpoint := range endpoints {
+			labels := fmt.Sprintf(`{endpoint=%q}`, endpoint)
+
+			m.value("atf_api_request_duration_seconds_sum"+labels, apiRequestMetrics[endpoint].seconds)
+			m.value("atf_api_request_duration_seconds_count"+labels, float64(apiRequestMetrics[endpoint].count))
+		}
+
+		m.header("atf_api_request_errors_total", "counter", "API requests which failed.")
+
+		for _, endpoint := range endpoints {
+			m.value(fmt.Sprintf(`atf_api_request_errors_total{endpoint=%q}`, endpoint), float64(apiRequestMetrics[endpoint].errors))
+		}
+
+		apiRequestMetricsMu.Unlock()
+
+		if index != nil {
+			libraryMetrics(m, index())
+		}
+
+		if m.err != nil {
+			log.Printf("Unable to write metrics, err: %s", m.err)
+		}
+	})
+}
+
+func libraryMetrics(m *metricsWriter, index *archiveIndex) {
+	files := make(map[string]int)
+	bytes := make(map[string]int64)
+
+	for _, file := range index.byPath {
+		files[file.Device.Identifier]++
+		bytes[file.Device.Identifier] += file.Size
+	}
+
+	devices := make([]string, 0, len(files))
+
+	for device := range files {
+		devices = append(devices, device)
+	}
+
+	sort.Strings(devices)
+
+	m.header("atf_library_files", "gauge", "Firmwares in the archive, per device.")
+
+	for _, device := range devices {
+		m.value(fmt.Sprintf(`atf_library_files{device=%q}`, device), float64(files[device]))
+	}
+
+	m.header("atf_library_bytes", "gauge", "Size of the firmwares in the archive, per device.")
+
+	for _, device := range devices {
+		m.value(fmt.Sprintf(`atf_library_bytes{device=%q}`, device), float64(bytes[device]))
+	}
+}
+
+// catalogLibraryIndex builds an archive index from the catalog on disk, for commands which
+// do not keep one in memory.
+func catalogLibraryIndex() *archiveIndex {
+	c, err := loadCatalog(catalogPath())
+
+	if err != nil {
+		c = &catalog{}
+	}
+
+	return buildArchiveIndex(c)
+}
+
+// serveMetrics starts a metrics only HTTP server on addr in the background.
+func serveMetrics(addr string, index func() *archiveIndex) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(index))
+
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+}
+
+type metricsWriter struct {
+	w   http.ResponseWriter
+	err error
+}
+
+func (m *metricsWriter) header(name, kind, help string) {
+	m.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m *metricsWriter) value(name string, value float64) {
+	m.printf("%s %s\n", name, formatMetricValue(value))
+}
+
+func (m *metricsWriter) metric(name, kind, help string, value float64) {
+	m.header(name, kind, help)
+	m.value(name, value)
+}
+
+func (m *metricsWriter) printf(format string, args ...interface{}) {
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.w, format, args...)
+	}
+}
+
+func formatMetricValue(value float64) string {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		return fmt.Sprintf("%d", int64(value))
+	}
+
+	return strings.TrimRight(fmt.Sprintf("%f", value), "0")
+}
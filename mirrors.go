@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// stringFlags collects repeated string flags.
+type stringFlags []string
+
+func (s *stringFlags) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringFlags) Set(value string) error {
+	*s = append(*s, value)
+
+	return nil
+}
+
+// urlRewrite replaces the prefix from of a firmware URL with to.
+type urlRewrite struct {
+	from, to string
+}
+
+func parseURLRewrites(rules []string) ([]urlRewrite, error) {
+	var rewrites []urlRewrite
+
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid rewrite rule: %s (expected from=to)", rule)
+		}
+
+		rewrites = append(rewrites, urlRewrite{from: parts[0], to: parts[1]})
+	}
+
+	return rewrites, nil
+}
+
+// rewriteURL applies the first matching rewrite rule to firmwareURL.
+func rewriteURL(firmwareURL string, rewrites []urlRewrite) string {
+	for _, rewrite := range rewrites {
+		if strings.HasPrefix(firmwareURL, rewrite.from) {
+			return rewrite.to + strings.TrimPrefix(firmwareURL, rewrite.from)
+		}
+	}
+
+	return firmwareURL
+}
+
+// mirrorURL returns the location of firmwareURL on a mirror, which is expected to serve
+// files at the same path as the original host.
+func mirrorURL(firmwareURL, mirror string) (string, error) {
+	u, err := url.Parse(firmwareURL)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(mirror, "/") + u.EscapedPath(), nil
+}
+
+// downloadSources lists the URLs to try, in order, for a firmware: the (possibly rewritten) URL,
+// each mirror, and finally the original URL.
+func downloadSources(firmwareURL string) []string {
+	sources := []string{rewriteURL(firmwareURL, urlRewrites)}
+
+	for _, mirror := range downloadMirrors {
+		u, err := mirrorURL(firmwareURL, mirror)
+
+		if err != nil {
+			continue
+		}
+
+		sources = append(sources, u)
+	}
+
+	sources = append(sources, firmwareURL)
+
+	// remove duplicates while keeping the order
+	seen := make(map[string]bool)
+	unique := sources[:0]
+
+	for _, source := range sources {
+		if !seen[source] {
+			seen[source] = true
+			unique = append(unique, source)
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// event names written with -output json
+const (
+	eventPlan              = "plan"
+	eventDownloadStarted   = "download_started"
+	eventDownloadProgress  = "download_progress"
+	eventDownloadCompleted = "download_completed"
+	eventDownloadFailed    = "download_failed"
+	eventVerify            = "verify"
+	eventSummary           = "summary"
+)
+
+var (
+	outputFormat string
+	outputMu     sync.Mutex
+)
+
+// outputEvent is a single line of -output json. Field names must not change, as other tools depend on them.
+type outputEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	Device     string `json:"device,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+	Version    string `json:"version,omitempty"`
+	BuildID    string `json:"buildid,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Path       string `json:"path,omitempty"`
+	SHA1       string `json:"sha1,omitempty"`
+	Size       uint64 `json:"size,omitempty"`
+
+	Downloaded uint64 `json:"downloaded,omitempty"`
+	Checksum   string `json:"checksum,omitempty"`
+	OK         *bool  `json:"ok,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	Summary *runSummary `json:"summary,omitempty"`
+}
+
+// exit codes of a download run
+const (
+	exitSuccess            = 0
+	exitPartialFailure     = 2
+	exitVerificationFailed = 3
+	exitAPIError           = 4
+	exitDeviceErrors       = 5
+	exitInterrupted        = 130 // as a shell reports a command killed by SIGINT
+)
+
+// runSummary totals up a run.
+type runSummary struct {
+	Downloaded      uint64  `json:"downloaded"`
+	Skipped         uint64  `json:"skipped"`
+	Failed          uint64  `json:"failed"`
+	Verified        uint64  `json:"verified"`
+	Corrupt         uint64  `json:"corrupt"`
+	Mismatched      uint64  `json:"mismatched"`
+	Bytes           uint64  `json:"bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	BytesPerSecond  uint64  `json:"bytes_per_second"`
+
+	FailedDevices []deviceFailure `json:"failed_devices,omitempty"`
+}
+
+// log prints the summary.
+func (s *runSummary) log() {
+	duration := time.Duration(s.DurationSeconds * float64(time.Second)).Round(time.Second)
+
+	log.Printf("Downloaded: %d, skipped: %d, failed: %d, verified: %d, corrupt: %d", s.Downloaded, s.Skipped, s.Failed, s.Verified, s.Corrupt)
+
+	if s.Mismatched > 0 {
+		log.Printf("Intact, but not matching the API's checksum: %d", s.Mismatched)
+	}
+	log.Printf("Downloaded %s in %s (%s/s)", humanize.Bytes(s.Bytes), duration, humanize.Bytes(s.BytesPerSecond))
+
+	if len(s.FailedDevices) > 0 {
+		log.Printf("Could not get firmwares for %d device(s):", len(s.FailedDevices))
+
+		for _, failure := range s.FailedDevices {
+			log.Printf("  %s: %s", failure.Identifier, failure.Error)
+		}
+	}
+}
+
+// exitCode returns the exit code for a run: a partial failure if any downloads failed, a
+// verification failure if any files did not match their checksum, a device error if the firmwares
+// for a device could not be retrieved (with -strict-devices), otherwise success.
+func (s *runSummary) exitCode() int {
+	switch {
+	case s.Failed > 0:
+		return exitPartialFailure
+	case s.Corrupt > 0:
+		return exitVerificationFailed
+	case strictDevices && len(s.FailedDevices) > 0:
+		return exitDeviceErrors
+	default:
+		return exitSuccess
+	}
+}
+
+// summarize totals up the run which started at start.
+func summarize(start time.Time) *runSummary {
+	s := &runSummary{
+		Downloaded:      atomic.LoadUint64(&filesDownloaded),
+		Skipped:         atomic.LoadUint64(&filesSkipped),
+		Failed:          atomic.LoadUint64(&filesFailed),
+		Verified:        atomic.LoadUint64(&filesVerified),
+		Corrupt:         atomic.LoadUint64(&filesCorrupt),
+		Mismatched:      atomic.LoadUint64(&filesMismatched),
+		Bytes:           atomic.LoadUint64(&downloadedSize),
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+
+	if s.DurationSeconds > 0 {
+		s.BytesPerSecond = uint64(float64(s.Bytes) / s.DurationSeconds)
+	}
+
+	return s
+}
+
+// firmwareEvent creates an event about a firmware.
+func firmwareEvent(event string, device *api.BaseDevice, ipsw *api.Firmware, path string) outputEvent {
+	e := outputEvent{
+		Event: event,
+		Path:  path,
+	}
+
+	if device != nil {
+		e.Device = device.Identifier
+		e.DeviceName = device.Name
+	}
+
+	if ipsw != nil {
+		e.Version = ipsw.Version
+		e.BuildID = ipsw.BuildID
+		e.URL = ipsw.URL
+		e.SHA1 = ipsw.SHA1Sum
+		e.Size = ipsw.Filesize
+	}
+
+	return e
+}
+
+// emit writes an event to stdout if -output json is set.
+func emit(e outputEvent) {
+	if outputFormat != outputJSON {
+		return
+	}
+
+	e.Time = time.Now()
+
+	b, err := json.Marshal(e)
+
+	if err != nil {
+		return
+	}
+
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	fmt.Fprintln(os.Stdout, string(b))
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// showProgressBar reports whether progress bars should be drawn: only for text output to a terminal.
+func showProgressBar() bool {
+	if outputFormat == outputJSON {
+		return false
+	}
+
+	info, err := os.Stdout.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressEmitter emits download_progress events at most once per interval.
+type progressEmitter struct {
+	event    outputEvent
+	interval time.Duration
+	last     time.Time
+}
+
+func (p *progressEmitter) update(downloaded int) {
+	if outputFormat != outputJSON || time.Since(p.last) < p.interval {
+		return
+	}
+
+	p.last = time.Now()
+	p.event.Downloaded = uint64(downloaded)
+
+	emit(p.event)
+}
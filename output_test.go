@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestExitCode(t *testing.T) {
+	failedDevices := []deviceFailure{{Identifier: "iPhone10,3", Error: "api returned 500"}}
+
+	tests := []struct {
+		name          string
+		summary       runSummary
+		strictDevices bool
+		expected      int
+	}{
+		{"nothing to do", runSummary{}, false, exitSuccess},
+		{"downloaded", runSummary{Downloaded: 2, Skipped: 1}, false, exitSuccess},
+		{"verified", runSummary{Verified: 3}, false, exitSuccess},
+		{"failed", runSummary{Downloaded: 1, Failed: 1}, false, exitPartialFailure},
+		{"corrupt", runSummary{Verified: 1, Corrupt: 1}, false, exitVerificationFailed},
+		{"failed and corrupt", runSummary{Failed: 1, Corrupt: 1}, false, exitPartialFailure},
+		{"failed devices", runSummary{Downloaded: 1, FailedDevices: failedDevices}, false, exitSuccess},
+		{"failed devices, strict", runSummary{Downloaded: 1, FailedDevices: failedDevices}, true, exitDeviceErrors},
+		{"corrupt and failed devices, strict", runSummary{Corrupt: 1, FailedDevices: failedDevices}, true, exitVerificationFailed},
+	}
+
+	defer func(strict bool) { strictDevices = strict }(strictDevices)
+
+	for _, test := range tests {
+		strictDevices = test.strictDevices
+
+		if code := test.summary.exitCode(); code != test.expected {
+			t.Errorf("%s: got %d, expected %d", test.name, code, test.expected)
+		}
+	}
+}
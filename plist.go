@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// decodePlist decodes an XML or binary property list. Dictionaries are returned as
+// map[string]interface{}, arrays as []interface{}, integers as int64, reals as float64,
+// data as []byte and dates as time.Time.
+func decodePlist(b []byte) (interface{}, error) {
+	if bytes.HasPrefix(b, []byte("bplist00")) {
+		return decodeBinaryPlist(b)
+	}
+
+	return decodeXMLPlist(b)
+}
+
+func decodeXMLPlist(b []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+
+	for {
+		token, err := d.Token()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local != "plist" {
+			return decodeXMLPlistValue(d, start)
+		}
+	}
+}
+
+func decodeXMLPlistValue(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := make(map[string]interface{})
+
+		var key string
+
+		for {
+			token, err := d.Token()
+
+			if err != nil {
+				return nil, err
+			}
+
+			switch t := token.(type) {
+			case xml.StartElement:
+				if t.Name.Local == "key" {
+					if err := d.DecodeElement(&key, &t); err != nil {
+						return nil, err
+					}
+
+					continue
+				}
+
+				value, err := decodeXMLPlistValue(d, t)
+
+				if err != nil {
+					return nil, err
+				}
+
+				dict[key] = value
+			case xml.EndElement:
+				return dict, nil
+			}
+		}
+
+	case "array":
+		array := make([]interface{}, 0)
+
+		for {
+			token, err := d.Token()
+
+			if err != nil {
+				return nil, err
+			}
+
+			switch t := token.(type) {
+			case xml.StartElement:
+				value, err := decodeXMLPlistValue(d, t)
+
+				if err != nil {
+					return nil, err
+				}
+
+				array = append(array, value)
+			case xml.EndElement:
+				return array, nil
+			}
+		}
+
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, err
+		}
+
+		return start.Name.Local == "true", nil
+	}
+
+	var text string
+
+	if err := d.DecodeElement(&text, &start); err != nil {
+		return nil, err
+	}
+
+	switch start.Name.Local {
+	case "string":
+		return text, nil
+	case "integer":
+		return strconv.ParseInt(strings.TrimSpace(text), 0, 64)
+	case "real":
+		return strconv.ParseFloat(strings.TrimSpace(text), 64)
+	case "date":
+		return time.Parse(time.RFC3339, strings.TrimSpace(text))
+	case "data":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	}
+
+	return nil, fmt.Errorf("unknown plist element: %s", start.Name.Local)
+}
+
+// binaryPlist decodes the objects of a binary property list.
+type binaryPlist struct {
+	b             []byte
+	offsets       []uint64
+	objectRefSize int
+	depth         int
+}
+
+// plistEpoch is the reference date of binary property list dates.
+var plistEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var errInvalidPlist = errors.New("invalid binary plist")
+
+func decodeBinaryPlist(b []byte) (interface{}, error) {
+	if len(b) < 40 {
+		return nil, errInvalidPlist
+	}
+
+	trailer := b[len(b)-32:]
+
+	offsetSize := int(trailer[6])
+	objectRefSize := int(trailer[7])
+	numObjects := binary.BigEndian.Uint64(trailer[8:])
+	topObject := binary.BigEndian.Uint64(trailer[16:])
+	offsetTable := binary.BigEndian.Uint64(trailer[24:])
+
+	if offsetSize < 1 || offsetSize > 8 || objectRefSize < 1 || objectRefSize > 8 ||
+		numObjects > uint64(len(b)) || offsetTable > uint64(len(b)) ||
+		offsetTable+numObjects*uint64(offsetSize) > uint64(len(b)) {
+		return nil, errInvalidPlist
+	}
+
+	p := &binaryPlist{
+		b:             b,
+		offsets:       make([]uint64, numObjects),
+		objectRefSize: objectRefSize,
+	}
+
+	for i := range p.offsets {
+		start := offsetTable + uint64(i*offsetSize)
+		p.offsets[i] = readUint(b[start : start+uint64(offsetSize)])
+	}
+
+	return p.object(topObject)
+}
+
+func readUint(b []byte) uint64 {
+	var n uint64
+
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+
+	return n
+}
+
+// count returns the length of the object at offset, which may follow the marker as an integer object.
+func (p *binaryPlist) count(offset uint64) (int, uint64, error) {
+	n := uint64(p.b[offset] & 0x0f)
+	offset++
+
+	if n != 0x0f {
+		return int(n), offset, nil
+	}
+
+	if offset >= uint64(len(p.b)) || p.b[offset]&0xf0 != 0x10 {
+		return 0, 0, errInvalidPlist
+	}
+
+	size := uint64(1) << (p.b[offset] & 0x0f)
+
+	if offset+1+size > uint64(len(p.b)) {
+		return 0, 0, errInvalidPlist
+	}
+
+	n = readUint(p.b[offset+1 : offset+1+size])
+
+	if n > uint64(len(p.b)) {
+		return 0, 0, errInvalidPlist
+	}
+
+	return int(n), offset + 1 + size, nil
+}
+
+func (p *binaryPlist) bytes(offset uint64, n int) ([]byte, error) {
+	if offset+uint64(n) > uint64(len(p.b)) {
+		return nil, errInvalidPlist
+	}
+
+	return p.b[offset : offset+uint64(n)], nil
+}
+
+func (p *binaryPlist) refs(offset uint64, n int) ([]uint64, error) {
+	b, err := p.bytes(offset, n*p.objectRefSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]uint64, n)
+
+	for i := range refs {
+		refs[i] = readUint(b[i*p.objectRefSize : (i+1)*p.objectRefSize])
+	}
+
+	return refs, nil
+}
+
+func (p *binaryPlist) object(ref uint64) (interface{}, error) {
+	if ref >= uint64(len(p.offsets)) || p.offsets[ref] >= uint64(len(p.b)) {
+		return nil, errInvalidPlist
+	}
+
+	// guard against reference cycles
+	if p.depth > 512 {
+		return nil, errInvalidPlist
+	}
+
+	p.depth++
+	defer func() { p.depth-- }()
+
+	offset := p.offsets[ref]
+	marker := p.b[offset]
+
+	switch marker & 0xf0 {
+	case 0x00:
+		switch marker {
+		case 0x08:
+			return false, nil
+		case 0x09:
+			return true, nil
+		}
+
+		return nil, nil
+
+	case 0x10:
+		b, err := p.bytes(offset+1, 1<<(marker&0x0f))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return int64(readUint(b)), nil
+
+	case 0x20:
+		b, err := p.bytes(offset+1, 1<<(marker&0x0f))
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch len(b) {
+		case 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+		case 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+		}
+
+		return nil, errInvalidPlist
+
+	case 0x30:
+		b, err := p.bytes(offset+1, 8)
+
+		if err != nil {
+			return nil, err
+		}
+
+		seconds := math.Float64frombits(binary.BigEndian.Uint64(b))
+
+		return plistEpoch.Add(time.Duration(seconds * float64(time.Second))), nil
+	}
+
+	n, start, err := p.count(offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker & 0xf0 {
+	case 0x40:
+		return p.bytes(start, n)
+
+	case 0x50:
+		b, err := p.bytes(start, n)
+
+		return string(b), err
+
+	case 0x60:
+		b, err := p.bytes(start, n*2)
+
+		if err != nil {
+			return nil, err
+		}
+
+		units := make([]uint16, n)
+
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(b[i*2:])
+		}
+
+		return string(utf16.Decode(units)), nil
+
+	case 0xa0:
+		refs, err := p.refs(start, n)
+
+		if err != nil {
+			return nil, err
+		}
+
+		array := make([]interface{}, n)
+
+		for i, ref := range refs {
+			if array[i], err = p.object(ref); err != nil {
+				return nil, err
+			}
+		}
+
+		return array, nil
+
+	case 0xd0:
+		refs, err := p.refs(start, n*2)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dict := make(map[string]interface{}, n)
+
+		for i := 0; i < n; i++ {
+			key, err := p.object(refs[i])
+
+			if err != nil {
+				return nil, err
+			}
+
+			keyString, ok := key.(string)
+
+			if !ok {
+				return nil, errInvalidPlist
+			}
+
+			if dict[keyString], err = p.object(refs[n+i]); err != nil {
+				return nil, err
+			}
+		}
+
+		return dict, nil
+	}
+
+	return nil, fmt.Errorf("unsupported binary plist object: 0x%02x", marker)
+}
+
+// plistString returns the string value of key in dict, or "".
+func plistString(dict map[string]interface{}, key string) string {
+	s, _ := dict[key].(string)
+	return s
+}
+
+// plistDict returns the dictionary value of key in dict, or nil.
+func plistDict(dict map[string]interface{}, key string) map[string]interface{} {
+	d, _ := dict[key].(map[string]interface{})
+	return d
+}
+
+// plistStrings returns the strings in the array value of key in dict.
+func plistStrings(dict map[string]interface{}, key string) []string {
+	array, _ := dict[key].([]interface{})
+
+	var strings []string
+
+	for _, value := range array {
+		if s, ok := value.(string); ok {
+			strings = append(strings, s)
+		}
+	}
+
+	return strings
+}
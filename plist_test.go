@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodePlist(t *testing.T) {
+	// the same dictionary as written by Python's plistlib with FMT_BINARY
+	binary, err := hex.DecodeString("62706c6973743030d70102030405060708090a0b0c0d10544461746154466c61675f101350726f647563744275696c6456657273696f6e5e50726f6475637456657273696f6e5453697a655f1015537570706f7274656450726f64756374547970657357556e69636f646542010209563135413337325431312e30130000011f71fb04cba20e0f5a6950686f6e6531302c335a6950686f6e6531302c366600630061006600e90020260308171c2137464b636b6e6f767b8487929d00000000000001010000000000000011000000000000000000000000000000aa")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xml := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Data</key>
+	<data>
+	AQI=
+	</data>
+	<key>Flag</key>
+	<true/>
+	<key>ProductBuildVersion</key>
+	<string>15A372</string>
+	<key>ProductVersion</key>
+	<string>11.0</string>
+	<key>Size</key>
+	<integer>1234567890123</integer>
+	<key>SupportedProductTypes</key>
+	<array>
+		<string>iPhone10,3</string>
+		<string>iPhone10,6</string>
+	</array>
+	<key>Unicode</key>
+	<string>café ☃</string>
+</dict>
+</plist>`)
+
+	expected := map[string]interface{}{
+		"Data":                  []byte{1, 2},
+		"Flag":                  true,
+		"ProductBuildVersion":   "15A372",
+		"ProductVersion":        "11.0",
+		"Size":                  int64(1234567890123),
+		"SupportedProductTypes": []interface{}{"iPhone10,3", "iPhone10,6"},
+		"Unicode":               "café ☃",
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"xml", xml},
+		{"binary", binary},
+	}
+
+	for _, test := range tests {
+		value, err := decodePlist(test.b)
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(value, expected) {
+			t.Errorf("%s: got %#v, expected %#v", test.name, value, expected)
+		}
+	}
+}
+
+func TestDecodeXMLPlistValues(t *testing.T) {
+	tests := []struct {
+		xml      string
+		expected interface{}
+	}{
+		{"<plist><false/></plist>", false},
+		{"<plist><integer>0x10</integer></plist>", int64(16)},
+		{"<plist><real>1.5</real></plist>", 1.5},
+		{"<plist><date>2017-09-19T17:00:00Z</date></plist>", time.Date(2017, 9, 19, 17, 0, 0, 0, time.UTC)},
+		{"<plist><array/></plist>", []interface{}{}},
+	}
+
+	for _, test := range tests {
+		value, err := decodePlist([]byte(test.xml))
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.xml, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("%s: got %#v, expected %#v", test.xml, value, test.expected)
+		}
+	}
+}
+
+func TestDecodeInvalidBinaryPlist(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"too short", []byte("bplist00")},
+		{"bad trailer", append([]byte("bplist00"), make([]byte, 40)...)},
+	}
+
+	for _, test := range tests {
+		if _, err := decodePlist(test.b); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
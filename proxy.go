@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// proxy serves firmwares by the path of their original URL, downloading them into the archive
+// the first time they are requested.
+func proxy(args []string) {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+
+	addr := flags.String("addr", ":8081", "the address to listen on")
+	refresh := flags.Duration("refresh", time.Hour, "how often to refresh the catalog from the API (0 to only use the cached catalog)")
+
+	flags.Parse(args)
+
+	p := &proxyServer{
+		apiServer: newAPIServer("", *refresh),
+		inFlight:  make(map[string]bool),
+	}
+
+	log.Printf("Proxying firmwares into %s on %s", archiveRoot(), *addr)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(p.archiveIndex))
+	mux.Handle("/", p)
+
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+type proxyServer struct {
+	*apiServer
+
+	pathsMu      sync.Mutex
+	pathsCatalog *catalog
+	paths        map[string]proxiedFirmware
+
+	inFlightMu sync.Mutex
+	inFlight   map[string]bool
+}
+
+type proxiedFirmware struct {
+	device   api.BaseDevice
+	firmware api.Firmware
+}
+
+// lookup finds the firmware whose original URL has the given path.
+func (p *proxyServer) lookup(urlPath string) (proxiedFirmware, bool) {
+	p.mu.RLock()
+	c := p.catalog
+	p.mu.RUnlock()
+
+	p.pathsMu.Lock()
+	defer p.pathsMu.Unlock()
+
+	if p.pathsCatalog != c {
+		p.paths = make(map[string]proxiedFirmware)
+		p.pathsCatalog = c
+
+		for _, device := range c.Devices {
+			for _, fw := range device.Firmwares {
+				u, err := url.Parse(fw.URL)
+
+				if err != nil {
+					continue
+				}
+
+				p.paths[u.Path] = proxiedFirmware{device: device.BaseDevice, firmware: fw}
+			}
+		}
+	}
+
+	fw, ok := p.paths[urlPath]
+
+	return fw, ok
+}
+
+func (p *proxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	proxied, ok := p.lookup(r.URL.Path)
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if file, ok := p.archiveIndex().byFirmware[firmwareKey(proxied.device.Identifier, proxied.firmware.URL)]; ok {
+		p.serveArchiveFile(w, r, file)
+		return
+	}
+
+	if proxied.firmware.SHA1Sum != "" {
+		w.Header().Set("ETag", `"`+proxied.firmware.SHA1Sum+`"`)
+	}
+
+	// the firmware is streamed as it is fetched, so Range requests get the whole file
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatUint(proxied.firmware.Filesize, 10))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	p.fetch(w, r, proxied)
+}
+
+// fetch downloads a firmware into the archive while streaming it to the client. Requests for a
+// firmware which is already being fetched are redirected to the original URL.
+func (p *proxyServer) fetch(w http.ResponseWriter, r *http.Request, proxied proxiedFirmware) {
+	ipsw := proxied.firmware
+	filename := filepath.Base(ipsw.URL)
+
+	p.inFlightMu.Lock()
+
+	if p.inFlight[ipsw.URL] {
+		p.inFlightMu.Unlock()
+
+		w.Header().Del("Content-Length")
+		http.Redirect(w, r, ipsw.URL, http.StatusFound)
+		return
+	}
+
+	p.inFlight[ipsw.URL] = true
+	p.inFlightMu.Unlock()
+
+	defer func() {
+		p.inFlightMu.Lock()
+		delete(p.inFlight, ipsw.URL)
+		p.inFlightMu.Unlock()
+	}()
+
+	downloadPath, err := parseDownloadPath(&ipsw, &proxied.device)
+	directory := filepath.Dir(downloadPath)
+
+	if err == nil {
+		err = os.MkdirAll(directory, 0700)
+	}
+
+	if err == nil {
+		err = ensureFreeSpace(directory, ipsw.Filesize)
+	}
+
+	if err != nil {
+		log.Printf("Unable to cache %s, err: %s", filename, err)
+
+		w.Header().Del("Content-Length")
+		http.Redirect(w, r, ipsw.URL, http.StatusFound)
+		return
+	}
+
+	partialPath := downloadPath + ".part"
+
+	log.Printf("Fetching %s for %s", filename, r.RemoteAddr)
+
+	// keep filling the cache even if the client goes away
+	client := &clientWriter{w: w}
+
+	checksum, err := download(context.Background(), rewriteURL(ipsw.URL, urlRewrites), partialPath, client, func(n, downloaded int, total int64) {
+		atomic.AddUint64(&downloadedSize, uint64(n))
+	})
+
+	if err == nil && checksum != ipsw.SHA1Sum {
+		log.Printf("File: %s failed checksum (wanted: %s, got: %s)", filename, ipsw.SHA1Sum, checksum)
+		err = errChecksum
+
+		atomic.AddUint64(&filesCorrupt, 1)
+	} else if err != nil {
+		atomic.AddUint64(&filesFailed, 1)
+	}
+
+	if err == nil {
+		err = os.Rename(partialPath, downloadPath)
+
+		if err != nil {
+			atomic.AddUint64(&filesFailed, 1)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error while fetching %s, err: %s", filename, err)
+		os.Remove(partialPath)
+
+		// abort the response so the client does not keep a bad file
+		panic(http.ErrAbortHandler)
+	}
+
+	writeDownloadMetadata(&proxied.device, &ipsw, downloadPath, rewriteURL(ipsw.URL, urlRewrites), checksum)
+
+	p.invalidateIndex()
+	atomic.AddUint64(&filesDownloaded, 1)
+
+	log.Printf("Cached %s", filename)
+}
+
+// clientWriter writes to an http.ResponseWriter, ignoring errors once the client has disconnected.
+type clientWriter struct {
+	w    http.ResponseWriter
+	gone bool
+}
+
+func (c *clientWriter) Write(b []byte) (int, error) {
+	if !c.gone {
+		if _, err := c.w.Write(b); err != nil {
+			c.gone = true
+		}
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// rangeReadAhead is the minimum amount read by each range request, so that the many small reads
+// made while parsing a zip's central directory or decompressing a member don't each become a request.
+const rangeReadAhead = 1 << 20
+
+// httpReaderAt reads a remote file with HTTP range requests.
+type httpReaderAt struct {
+	url  string
+	size int64
+
+	mu        sync.Mutex
+	buf       []byte
+	bufOffset int64
+}
+
+// openRemoteZip opens the zip file at url, reading only the parts that are needed.
+func openRemoteZip(url string) (*zip.Reader, error) {
+	r, err := newHTTPReaderAt(url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return zip.NewReader(r, r.size)
+}
+
+func newHTTPReaderAt(url string) (*httpReaderAt, error) {
+	resp, err := httpClient.Head(url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid status code: %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength < 0 {
+		return nil, errors.New("server did not send the file size")
+	}
+
+	return &httpReaderAt{url: url, size: resp.ContentLength}, nil
+}
+
+func (r *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+
+	for n < len(p) {
+		pos := off + int64(n)
+
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		if pos < r.bufOffset || pos >= r.bufOffset+int64(len(r.buf)) {
+			length := int64(len(p) - n)
+
+			if length < rangeReadAhead {
+				length = rangeReadAhead
+			}
+
+			if err := r.fetch(pos, length); err != nil {
+				return n, err
+			}
+		}
+
+		n += copy(p[n:], r.buf[pos-r.bufOffset:])
+	}
+
+	return n, nil
+}
+
+// fetch replaces the buffer with length bytes starting at off.
+func (r *httpReaderAt) fetch(off, length int64) error {
+	if off+length > r.size {
+		length = r.size - off
+	}
+
+	req, err := http.NewRequest("GET", r.url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+
+	resp, err := httpClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("server does not support range requests (status code: %d)", resp.StatusCode)
+	}
+
+	if err := bandwidthLimiter.wait(req.Context(), int(length)); err != nil {
+		return err
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, length))
+
+	if err != nil {
+		return err
+	}
+
+	if int64(len(buf)) != length {
+		return io.ErrUnexpectedEOF
+	}
+
+	atomic.AddUint64(&downloadedSize, uint64(length))
+
+	r.buf = buf
+	r.bufOffset = off
+
+	return nil
+}
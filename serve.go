@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// serve exposes the catalog as an ipsw.me v4 compatible API, with firmware URLs pointing
+// at the local archive wherever the file has been downloaded.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+
+	addr := flags.String("addr", ":8080", "the address to listen on")
+	publicURL := flags.String("public-url", "", "the URL clients reach this server at (defaults to the Host of each request)")
+	refresh := flags.Duration("refresh", time.Hour, "how often to refresh the catalog from the API (0 to only use the cached catalog)")
+
+	flags.Parse(args)
+
+	s := newAPIServer(strings.TrimSuffix(*publicURL, "/"), *refresh)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/", s.serveFiles)
+	mux.Handle("/metrics", metricsHandler(s.archiveIndex))
+	mux.Handle("/", s)
+	mux.Handle("/v4/", http.StripPrefix("/v4", s))
+
+	log.Printf("Serving %s on %s", archiveRoot(), *addr)
+
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+type apiServer struct {
+	publicURL string
+
+	mu      sync.RWMutex
+	catalog *catalog
+
+	indexMu sync.Mutex
+	index   *archiveIndex
+}
+
+// newAPIServer creates an apiServer from the cached catalog, refreshing it from the API every
+// refresh interval (if non-zero).
+func newAPIServer(publicURL string, refresh time.Duration) *apiServer {
+	c, err := loadCatalog(catalogPath())
+
+	if err != nil {
+		log.Fatalf("Unable to load catalog: %s, err: %s", catalogPath(), err)
+	}
+
+	s := &apiServer{
+		publicURL: publicURL,
+		catalog:   c,
+	}
+
+	if refresh > 0 {
+		go s.refreshCatalog(refresh)
+	}
+
+	return s
+}
+
+// invalidateIndex forces the archive index to be rebuilt on next use.
+func (s *apiServer) invalidateIndex() {
+	s.indexMu.Lock()
+	s.index = nil
+	s.indexMu.Unlock()
+}
+
+// refreshCatalog periodically replaces the catalog with fresh API data, keeping the cached
+// copy if the API cannot be reached.
+func (s *apiServer) refreshCatalog(interval time.Duration) {
+	for {
+		c, failures, err := fetchCatalog("")
+
+		if err == nil {
+			s.mu.RLock()
+
+			// keep serving the last known data for devices which could not be refreshed
+			for _, failure := range failures {
+				if device := s.catalog.device(failure.Identifier); device != nil {
+					c.setDevice(device)
+				}
+			}
+
+			s.mu.RUnlock()
+		}
+
+		if err != nil {
+			log.Printf("Unable to refresh catalog, err: %s", err)
+		} else {
+			s.mu.Lock()
+			s.catalog = c
+			s.mu.Unlock()
+
+			s.invalidateIndex()
+
+			recordSigningStatus(c.Devices)
+
+			if err := c.save(catalogPath()); err != nil {
+				log.Printf("Unable to save catalog, err: %s", err)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	index := s.archiveIndex()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	switch {
+	case len(parts) == 1 && parts[0] == "devices":
+		devices := make([]api.BaseDevice, 0, len(s.catalog.Devices))
+
+		for _, device := range s.catalog.Devices {
+			devices = append(devices, device.BaseDevice)
+		}
+
+		writeJSON(w, devices)
+
+	case len(parts) == 2 && parts[0] == "device":
+		device := s.catalog.device(parts[1])
+
+		if device == nil || r.URL.Query().Get("type") == "ota" {
+			http.NotFound(w, r)
+			return
+		}
+
+		localDevice := *device
+		localDevice.Firmwares = make([]api.Firmware, len(device.Firmwares))
+
+		for i, fw := range device.Firmwares {
+			localDevice.Firmwares[i] = s.localFirmware(r, index, device, fw)
+		}
+
+		writeJSON(w, localDevice)
+
+	case len(parts) == 3 && parts[0] == "ipsw":
+		device := s.catalog.device(parts[1])
+
+		if device == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		for _, fw := range device.Firmwares {
+			if fw.BuildID == parts[2] {
+				writeJSON(w, s.localFirmware(r, index, device, fw))
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+
+	case len(parts) == 2 && parts[0] == "ipsw":
+		firmwares := make([]api.Firmware, 0)
+
+		for _, device := range s.catalog.Devices {
+			for _, fw := range device.Firmwares {
+				if fw.Version == parts[1] {
+					firmwares = append(firmwares, s.localFirmware(r, index, device, fw))
+				}
+			}
+		}
+
+		writeJSON(w, firmwares)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// localFirmware returns fw with its URL rewritten to this server if it exists in the archive.
+func (s *apiServer) localFirmware(r *http.Request, index *archiveIndex, device *api.Device, fw api.Firmware) api.Firmware {
+	file, ok := index.byFirmware[firmwareKey(device.Identifier, fw.URL)]
+
+	if !ok {
+		return fw
+	}
+
+	base := s.publicURL
+
+	if base == "" {
+		scheme := "http"
+
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		base = scheme + "://" + r.Host
+	}
+
+	fw.URL = base + (&url.URL{Path: path.Join("/files", file.RelPath)}).EscapedPath()
+
+	return fw
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Unable to write response, err: %s", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+var (
+	writeSidecars, writeSHA1Files, writeSHA1Sums bool
+
+	// sha1SumsMu serialises updates to SHA1SUMS files, as the proxy can download several files at once.
+	sha1SumsMu sync.Mutex
+)
+
+// sha1SumsName is the name of the directory-level checksum file, compatible with sha1sum -c.
+const sha1SumsName = "SHA1SUMS"
+
+// sidecar is written alongside each downloaded IPSW, so the archive describes itself without the tool.
+type sidecar struct {
+	Device     *api.BaseDevice `json:"device"`
+	Firmware   *api.Firmware   `json:"firmware"`
+	Downloaded time.Time       `json:"downloaded"`
+	Source     string          `json:"source"`
+}
+
+// writeDownloadMetadata writes the sidecar and checksum files enabled by the flags for a downloaded IPSW.
+// Failures are only logged, as the download itself succeeded.
+func writeDownloadMetadata(device *api.BaseDevice, ipsw *api.Firmware, downloadPath, source, checksum string) {
+	if writeSidecars {
+		b, err := json.MarshalIndent(sidecar{
+			Device:     device,
+			Firmware:   ipsw,
+			Downloaded: time.Now(),
+			Source:     source,
+		}, "", "  ")
+
+		if err == nil {
+			err = writeFileAtomic(downloadPath+".json", append(b, '\n'), 0644)
+		}
+
+		if err != nil {
+			log.Printf("Unable to write metadata for %s, err: %s", filepath.Base(downloadPath), err)
+		}
+	}
+
+	line := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(downloadPath))
+
+	if writeSHA1Files {
+		if err := writeFileAtomic(downloadPath+".sha1", []byte(line), 0644); err != nil {
+			log.Printf("Unable to write checksum for %s, err: %s", filepath.Base(downloadPath), err)
+		}
+	}
+
+	if writeSHA1Sums {
+		if err := updateSHA1Sums(filepath.Dir(downloadPath), filepath.Base(downloadPath), checksum); err != nil {
+			log.Printf("Unable to update %s for %s, err: %s", sha1SumsName, filepath.Base(downloadPath), err)
+		}
+	}
+}
+
+// updateSHA1Sums adds or replaces the checksum of filename in the SHA1SUMS file in directory.
+func updateSHA1Sums(directory, filename, checksum string) error {
+	sha1SumsMu.Lock()
+	defer sha1SumsMu.Unlock()
+
+	path := filepath.Join(directory, sha1SumsName)
+
+	sums := make(map[string]string)
+
+	f, err := os.Open(path)
+
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			// "<sha1>  <name>", or "<sha1> *<name>" in binary mode
+			fields := strings.SplitN(scanner.Text(), " ", 2)
+
+			if len(fields) == 2 {
+				sums[strings.TrimLeft(fields[1], " *")] = fields[0]
+			}
+		}
+
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	sums[filename] = checksum
+
+	names := make([]string, 0, len(sums))
+
+	for name := range sums {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var b strings.Builder
+
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", sums[name], name)
+	}
+
+	return writeFileAtomic(path, []byte(b.String()), 0644)
+}
+
+// writeFileAtomic writes a file under a temporary name first, so that it is never seen half written.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, b, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
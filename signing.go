@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// signingHistory records when each firmware was seen to be signed or unsigned.
+type signingHistory struct {
+	Firmwares map[string]*signingRecord `json:"firmwares"`
+}
+
+type signingRecord struct {
+	Identifier string          `json:"identifier"`
+	Version    string          `json:"version"`
+	BuildID    string          `json:"buildid"`
+	Signed     bool            `json:"signed"`
+	LastSeen   time.Time       `json:"last_seen"`
+	Changes    []signingChange `json:"changes"`
+}
+
+// signingChange is a change in signing status. The first change of a record is when it was first seen.
+type signingChange struct {
+	Time   time.Time `json:"time"`
+	Signed bool      `json:"signed"`
+}
+
+// signingTransition is a firmware which has become signed or stopped being signed.
+type signingTransition struct {
+	Device   api.BaseDevice
+	Firmware api.Firmware
+	Time     time.Time
+}
+
+func signingHistoryPath() string {
+	return filepath.Join(stateDirectory(), "signing.json")
+}
+
+func loadSigningHistory(path string) (*signingHistory, error) {
+	h := &signingHistory{Firmwares: make(map[string]*signingRecord)}
+
+	b, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, h); err != nil {
+		return nil, err
+	}
+
+	if h.Firmwares == nil {
+		h.Firmwares = make(map[string]*signingRecord)
+	}
+
+	return h, nil
+}
+
+func (h *signingHistory) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(h, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, b, 0600)
+}
+
+// record updates the history with the signing status of every firmware for device, returning any transitions.
+func (h *signingHistory) record(device *api.Device, now time.Time) []signingTransition {
+	var transitions []signingTransition
+
+	for _, fw := range device.Firmwares {
+		key := device.Identifier + " " + fw.BuildID
+
+		record, ok := h.Firmwares[key]
+
+		if !ok {
+			h.Firmwares[key] = &signingRecord{
+				Identifier: device.Identifier,
+				Version:    fw.Version,
+				BuildID:    fw.BuildID,
+				Signed:     fw.Signed,
+				LastSeen:   now,
+				Changes:    []signingChange{{Time: now, Signed: fw.Signed}},
+			}
+
+			continue
+		}
+
+		record.LastSeen = now
+
+		if record.Signed == fw.Signed {
+			continue
+		}
+
+		record.Signed = fw.Signed
+		record.Changes = append(record.Changes, signingChange{Time: now, Signed: fw.Signed})
+
+		transitions = append(transitions, signingTransition{
+			Device:   device.BaseDevice,
+			Firmware: fw,
+			Time:     now,
+		})
+	}
+
+	return transitions
+}
+
+// recordSigningStatus adds the signing status of the given devices to the stored history,
+// logging and returning any changes.
+func recordSigningStatus(devices []*api.Device) []signingTransition {
+	history, err := loadSigningHistory(signingHistoryPath())
+
+	if err != nil {
+		log.Printf("Unable to load signing history, err: %s", err)
+		return nil
+	}
+
+	now := time.Now()
+
+	var transitions []signingTransition
+
+	for _, device := range devices {
+		transitions = append(transitions, history.record(device, now)...)
+	}
+
+	for _, transition := range transitions {
+		transition := transition
+
+		fireHook(hookEvent{Event: hookSigningChange, Device: &transition.Device, Firmware: &transition.Firmware})
+
+		if transition.Firmware.Signed {
+			log.Printf("%s %s (%s) is now signed", transition.Device.Name, transition.Firmware.Version, transition.Firmware.BuildID)
+		} else {
+			log.Printf("%s %s (%s) is no longer signed", transition.Device.Name, transition.Firmware.Version, transition.Firmware.BuildID)
+		}
+	}
+
+	if err := history.save(signingHistoryPath()); err != nil {
+		log.Printf("Unable to save signing history, err: %s", err)
+	}
+
+	return transitions
+}
+
+// signing prints the recorded signing status and history of firmwares.
+func signing(args []string) {
+	flags := flag.NewFlagSet("signing", flag.ExitOnError)
+
+	device := flags.String("device", specifiedDevice, "only show firmwares for this device (defaults to -i)")
+	version := flags.String("version", "", "only show firmwares with this version")
+	update := flags.Bool("update", false, "fetch the current signing status from the API first")
+	showAll := flags.Bool("all", false, "show unsigned firmwares which have never changed status")
+
+	flags.Parse(args)
+
+	if *update {
+		defer waitForHooks()
+
+		c, _, err := fetchCatalog(*device)
+
+		if err != nil {
+			log.Fatalf("Unable to retrieve firmware information, err: %s", err)
+		}
+
+		recordSigningStatus(c.Devices)
+	}
+
+	history, err := loadSigningHistory(signingHistoryPath())
+
+	if err != nil {
+		log.Fatalf("Unable to load signing history, err: %s", err)
+	}
+
+	var records []*signingRecord
+
+	for _, record := range history.Firmwares {
+		if *device != "" && record.Identifier != *device {
+			continue
+		}
+
+		if *version != "" && record.Version != *version {
+			continue
+		}
+
+		if !*showAll && !record.Signed && len(record.Changes) == 1 {
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		log.Printf("No signing history recorded, run with -update to fetch it")
+		return
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Identifier != records[j].Identifier {
+			return records[i].Identifier < records[j].Identifier
+		}
+
+		return records[i].BuildID < records[j].BuildID
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "DEVICE\tVERSION\tBUILD\tSIGNED\tSINCE\tLAST CHECKED")
+
+	for _, record := range records {
+		since := record.Changes[len(record.Changes)-1].Time
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", record.Identifier, record.Version, record.BuildID, yesNo(record.Signed), formatSigningTime(since), formatSigningTime(record.LastSeen))
+	}
+
+	w.Flush()
+
+	type change struct {
+		record *signingRecord
+		signingChange
+	}
+
+	var changes []change
+
+	for _, record := range records {
+		// the first change is when the firmware was first seen, not a transition
+		for _, c := range record.Changes[1:] {
+			changes = append(changes, change{record, c})
+		}
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Time.Before(changes[j].Time)
+	})
+
+	fmt.Println()
+	fmt.Println("History:")
+
+	for _, c := range changes {
+		status := "stopped being signed"
+
+		if c.Signed {
+			status = "became signed"
+		}
+
+		fmt.Printf("%s  %s %s (%s) %s\n", formatSigningTime(c.Time), c.record.Identifier, c.record.Version, c.record.BuildID, status)
+	}
+}
+
+func formatSigningTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+
+	return "no"
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// templateFuncs are available in the -d, -filename and extract -o templates.
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+
+	// replace old new s, e.g. {{.Name | replace " " "_"}}
+	"replace": func(old, new, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+
+	// date layout t, e.g. {{.ReleaseDate | date "2006-01"}}, is "" for unknown dates
+	"date": func(layout string, t interface{}) string {
+		switch t := t.(type) {
+		case time.Time:
+			return t.Format(layout)
+		case null.Time:
+			if t.Valid {
+				return t.Time.Format(layout)
+			}
+		}
+
+		return ""
+	},
+
+	"major":    majorVersion,
+	"minor":    minorVersion,
+	"sanitize": sanitizePathElement,
+
+	// default value v, e.g. {{.Year | default "unknown"}}
+	"default": func(value, v interface{}) interface{} {
+		if v == nil || reflect.ValueOf(v).IsZero() {
+			return value
+		}
+
+		return v
+	},
+}
+
+// majorVersion returns the major part of a version, e.g. 11 for 11.2.5.
+func majorVersion(version string) string {
+	return strings.SplitN(version, ".", 2)[0]
+}
+
+// minorVersion returns the major and minor parts of a version, e.g. 11.2 for 11.2.5.
+func minorVersion(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+
+	if len(parts) < 2 {
+		return version
+	}
+
+	return parts[0] + "." + parts[1]
+}
+
+// sanitizePathElement replaces characters which are not allowed in file names on common filesystems.
+func sanitizePathElement(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+
+		return r
+	}, s)
+
+	return strings.Trim(s, " .")
+}
+
+// Family is the kind of device, e.g. iPhone, iPad or AppleTV.
+func (c *fwDeviceCombo) Family() string {
+	if i := strings.IndexFunc(c.Identifier, unicode.IsDigit); i > 0 {
+		return c.Identifier[:i]
+	}
+
+	return c.Identifier
+}
+
+// Year is the year the firmware was released (or uploaded, if the release date is unknown), or "".
+func (c *fwDeviceCombo) Year() string {
+	switch {
+	case c.ReleaseDate.Valid:
+		return c.ReleaseDate.Time.Format("2006")
+	case c.UploadDate.Valid:
+		return c.UploadDate.Time.Format("2006")
+	}
+
+	return ""
+}
+
+// MajorVersion is the major part of the firmware version, e.g. 11 for 11.2.5.
+func (c *fwDeviceCombo) MajorVersion() string {
+	return majorVersion(c.Version)
+}
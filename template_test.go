@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestDownloadTemplates(t *testing.T) {
+	released := &api.Firmware{
+		Identifier:  "iPhone10,3",
+		Version:     "11.2.5",
+		BuildID:     "15D60",
+		ReleaseDate: null.TimeFrom(time.Date(2018, 1, 23, 0, 0, 0, 0, time.UTC)),
+		UploadDate:  null.TimeFrom(time.Date(2018, 1, 22, 0, 0, 0, 0, time.UTC)),
+	}
+
+	uploaded := &api.Firmware{
+		Identifier: "AppleTV5,3",
+		Version:    "9",
+		UploadDate: null.TimeFrom(time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)),
+	}
+
+	undated := &api.Firmware{Identifier: "iPad1,1", Version: "1.0"}
+
+	tests := []struct {
+		template string
+		firmware *api.Firmware
+		expected string
+	}{
+		{"{{.Family}}", released, "iPhone"},
+		{"{{.Family}}", uploaded, "AppleTV"},
+		{"{{.Family}}", undated, "iPad"},
+		{"{{.Year}}", released, "2018"},
+		{"{{.Year}}", uploaded, "2015"},
+		{"{{.Year}}", undated, ""},
+		{"{{.MajorVersion}}", released, "11"},
+		{"{{.Version | major}}", uploaded, "9"},
+		{"{{.Version | minor}}", released, "11.2"},
+		{"{{.Version | minor}}", uploaded, "9"},
+		{"{{.Family | lower}}-{{.BuildID | upper}}", released, "iphone-15D60"},
+		{`{{.Name | replace " " "_"}}`, released, "iPhone_X_(Global)"},
+		{`{{.ReleaseDate | date "2006-01-02"}}`, released, "2018-01-23"},
+		{`{{.ReleaseDate | date "2006"}}`, undated, ""},
+		{`{{.Name | sanitize}}`, released, "iPhone X (Global)"},
+		{`{{.Year | default "unknown"}}`, undated, "unknown"},
+		{`{{.Year | default "unknown"}}`, released, "2018"},
+		{`{{.BuildID | default "none"}}`, uploaded, "none"},
+	}
+
+	for _, test := range tests {
+		tmpl, err := template.New("test").Funcs(templateFuncs).Parse(test.template)
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.template, err)
+			continue
+		}
+
+		var b bytes.Buffer
+
+		device := &api.BaseDevice{Identifier: test.firmware.Identifier, Name: "iPhone X (Global)"}
+
+		if err := tmpl.Execute(&b, &fwDeviceCombo{device.Identifier, device, test.firmware}); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.template, err)
+			continue
+		}
+
+		if b.String() != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.template, b.String(), test.expected)
+		}
+	}
+}
+
+func TestSanitizePathElement(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected string
+	}{
+		{"iPhone 8", "iPhone 8"},
+		{"a/b\\c", "a_b_c"},
+		{`what?: "*<>|`, "what__ _____"},
+		{"tab\there", "tab_here"},
+		{" ..hidden. ", "hidden"},
+	}
+
+	for _, test := range tests {
+		if s := sanitizePathElement(test.s); s != test.expected {
+			t.Errorf("%q: got %q, expected %q", test.s, s, test.expected)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cj123/go-ipsw/api"
+)
+
+// watch polls the API and downloads newly released firmwares matching the selection flags.
+// The first interrupt stops once the current download has finished, a second aborts it.
+func watch(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+
+	interval := flags.Duration("interval", 30*time.Minute, "how often to check for new firmwares")
+
+	flags.Parse(args)
+
+	ctx, abort := context.WithCancel(context.Background())
+	stopping := make(chan struct{})
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		log.Printf("Stopping once the current download has finished, interrupt again to abort it")
+		close(stopping)
+
+		<-signals
+		log.Printf("Aborting current download")
+		abort()
+	}()
+
+	previous, err := loadCatalog(catalogPath())
+
+	if err != nil {
+		log.Fatalf("Unable to load catalog: %s, err: %s", catalogPath(), err)
+	}
+
+	log.Printf("Checking for new firmwares every %s", *interval)
+
+	defer waitForHooks()
+
+	// firmwares which have been reported as new, but not downloaded yet
+	announced := make(map[string]bool)
+
+	for {
+		if !checkForNewFirmwares(ctx, stopping, previous, announced) {
+			return
+		}
+
+		select {
+		case <-stopping:
+			return
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// checkForNewFirmwares fetches the latest API data, downloads any selected firmwares which are not
+// in previous and records the new data in previous. Devices which are not in previous yet are only
+// recorded, and firmwares are only recorded once they have been downloaded, so that failed downloads
+// are retried on the next check. It returns false if watch should stop.
+func checkForNewFirmwares(ctx context.Context, stopping <-chan struct{}, previous *catalog, announced map[string]bool) bool {
+	current, _, err := fetchCatalog(specifiedDevice)
+
+	if err != nil {
+		log.Printf("Unable to retrieve firmware information, err: %s", err)
+		return true
+	}
+
+	recordSigningStatus(current.Devices)
+
+	added := previous.newFirmwares(current)
+	downloads := make(map[*api.Device][]api.Firmware)
+	pending := make(map[*api.Device]map[string]bool)
+	baseline := 0
+
+	for _, device := range current.Devices {
+		if previous.device(device.Identifier) == nil {
+			previous.setDevice(device)
+			baseline++
+			continue
+		}
+
+		newFirmwares := make(map[string]bool)
+
+		for _, ipsw := range added[device] {
+			ipsw := ipsw
+
+			newFirmwares[ipsw.URL] = true
+
+			if announced[ipsw.URL] {
+				continue
+			}
+
+			announced[ipsw.URL] = true
+
+			log.Printf("New firmware: %s %s (%s)", device.Name, ipsw.Version, ipsw.BuildID)
+			fireHook(hookEvent{Event: hookNewFirmware, Device: &device.BaseDevice, Firmware: &ipsw})
+		}
+
+		pending[device] = make(map[string]bool)
+
+		for _, ipsw := range selectFirmwares(device) {
+			if newFirmwares[ipsw.URL] {
+				downloads[device] = append(downloads[device], ipsw)
+				pending[device][ipsw.URL] = true
+			}
+		}
+
+		previous.setDevice(withoutFirmwares(device, pending[device]))
+	}
+
+	if err := previous.save(catalogPath()); err != nil {
+		log.Printf("Unable to save catalog, err: %s", err)
+	}
+
+	if baseline > 0 {
+		log.Printf("Recorded %d devices, their new firmwares will be downloaded from now on", baseline)
+	}
+
+	for _, device := range current.Devices {
+		selected := downloads[device]
+
+		atomic.AddInt64(&downloadQueueDepth, int64(len(selected)))
+
+		for i, ipsw := range selected {
+			select {
+			case <-stopping:
+				atomic.AddInt64(&downloadQueueDepth, -int64(len(selected)-i))
+				return false
+			default:
+			}
+
+			atomic.AddInt64(&downloadQueueDepth, -1)
+
+			ipsw := ipsw
+
+			if err := downloadFirmware(ctx, &device.BaseDevice, &ipsw); err != nil {
+				if ctx.Err() != nil {
+					return false
+				}
+
+				log.Printf("Unable to download %s, err: %s", filepath.Base(ipsw.URL), err)
+				continue
+			}
+
+			delete(pending[device], ipsw.URL)
+			previous.setDevice(withoutFirmwares(device, pending[device]))
+
+			if err := previous.save(catalogPath()); err != nil {
+				log.Printf("Unable to save catalog, err: %s", err)
+			}
+		}
+	}
+
+	return true
+}
+
+// withoutFirmwares returns a copy of device without the firmwares whose URLs are in urls.
+func withoutFirmwares(device *api.Device, urls map[string]bool) *api.Device {
+	d := *device
+	d.Firmwares = nil
+
+	for _, ipsw := range device.Firmwares {
+		if !urls[ipsw.URL] {
+			d.Firmwares = append(d.Firmwares, ipsw)
+		}
+	}
+
+	return &d
+}
+
+// downloadFirmware downloads a single firmware into its download directory, unless it already exists.
+// A partially downloaded file is removed if ctx is cancelled.
+func downloadFirmware(ctx context.Context, device *api.BaseDevice, ipsw *api.Firmware) error {
+	downloadPath, err := parseDownloadPath(ipsw, device)
+
+	if err != nil {
+		return err
+	}
+
+	directory := filepath.Dir(downloadPath)
+
+	if _, err := os.Stat(downloadPath); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return err
+	}
+
+	if err := ensureFreeSpace(directory, ipsw.Filesize); err != nil {
+		return err
+	}
+
+	err = downloadWithRetries(ctx, device, ipsw, downloadPath)
+
+	if err != nil && ctx.Err() != nil {
+		os.Remove(downloadPath)
+	}
+
+	return err
+}